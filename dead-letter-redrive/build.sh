@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+
+go build -o releases/dead-letter-redrive-`uname -s`-`uname -m`
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DeadLetter is a record the receiver writes for an event
+// it was unable to deliver.
+type DeadLetter struct {
+	EventID   string      `json:"event_id"`
+	RelatedID string      `json:"related_id"`
+	Target    string      `json:"target"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Unsigned  bool        `json:"unsigned,omitempty"`
+	Reason    string      `json:"reason"`
+	Attempts  int         `json:"attempts"`
+	Time      time.Time   `json:"time"`
+}
+
+func redrive(dl *DeadLetter, target string) error {
+	if target == "" {
+		target = dl.Target
+	}
+	if dl.Unsigned {
+		// the receiver keeps no credentials in dead letters
+		log.Printf("Event '%s' was dispatched with signed media URLs, they are re-driven unsigned\n", dl.EventID)
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(dl.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range dl.Header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bts, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 202 {
+		return &redriveError{status: resp.StatusCode, body: string(bts)}
+	}
+	return nil
+}
+
+type redriveError struct {
+	status int
+	body   string
+}
+
+func (e *redriveError) Error() string {
+	return http.StatusText(e.status) + ": " + e.body
+}
+
+// writeRemaining writes the lines that are left to path. Writing to a temporary
+// file first keeps the dead letters intact should the tool fail halfway.
+func writeRemaining(path string, remaining [][]byte) error {
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, line := range remaining {
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func main() {
+	pathPtr := flag.String("dead-letter-file", "dead-letter.jsonl", "path to a file the receiver dead-lettered events to")
+	targetPtr := flag.String("target", "", "URL to re-drive events to instead of the one they were dead-lettered from")
+	remainingPtr := flag.String("remaining-file", "remaining.jsonl", "path to write the events that failed again to")
+	inPlacePtr := flag.Bool("in-place", false, "rewrite the dead letter file with the events that failed again")
+	flag.Parse()
+
+	if *inPlacePtr {
+		*remainingPtr = *pathPtr
+	}
+
+	deadLetters, err := os.Open(*pathPtr)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// lines that fail to parse are kept as they are, so nothing is lost
+	var remaining [][]byte
+	redriven, failed, malformed := 0, 0, 0
+	reader := bufio.NewReader(deadLetters)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err.Error())
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var dl DeadLetter
+			if uerr := json.Unmarshal(line, &dl); uerr != nil {
+				log.Printf("Keeping malformed dead letter, reason: '%s'\n", uerr.Error())
+				malformed++
+				remaining = append(remaining, line)
+			} else if rerr := redrive(&dl, *targetPtr); rerr != nil {
+				log.Printf("Unable to re-drive event '%s' related to '%s', reason: '%s'\n",
+					dl.EventID, dl.RelatedID, rerr.Error())
+				dl.Reason = rerr.Error()
+				dl.Attempts++
+				dl.Time = time.Now().UTC()
+				b, merr := json.Marshal(&dl)
+				if merr != nil {
+					log.Fatal(merr.Error())
+				}
+				failed++
+				remaining = append(remaining, b)
+			} else {
+				redriven++
+				log.Printf("Event '%s' related to '%s' re-driven successfully!\n", dl.EventID, dl.RelatedID)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	deadLetters.Close()
+
+	log.Printf("%d event(s) re-driven, %d failed, %d malformed\n", redriven, failed, malformed)
+	if len(remaining) == 0 && !*inPlacePtr {
+		return
+	}
+	if err := writeRemaining(*remainingPtr, remaining); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Remaining events written to '%s'\n", *remainingPtr)
+}
@@ -341,6 +341,9 @@ def with_graph(label_map):
         if data is not None or len(data) !=0:
             data = ujson.loads(data)
             log.info("incoming data: {0}".format(ujson.dumps(data)))
+            if "specversion" in data:
+                # structured CloudEvent dispatched by the receiver
+                data = data.get("data", {})
             media = data.get("media", [])
             event_id = data.get("event_id")
             event_type = data.get("event_type", "")
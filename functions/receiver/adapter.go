@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Media is a reference to a stored object an event is about.
+// ContentType and Size are only known for providers that report them,
+// a Size of 0 means unknown.
+//
+// Object identifies the stored object across events, independent of how its
+// URL is built, ETag tells versions of its content apart and Sequencer orders
+// the events of the object, see ObjectTracker. Deleted media refers to an
+// object that is gone, Overwrite media replaces an earlier version and
+// OutOfOrder media is older than a version dispatched before. Probe holds
+// what the pre-flight probe found out about the media, if it ran.
+type Media struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Object      string `json:"object,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Sequencer   string `json:"sequencer,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+	OutOfOrder  bool   `json:"out_of_order,omitempty"`
+
+	Probe *MediaProbe `json:"probe,omitempty"`
+
+	// signer grants access to the media of private buckets
+	signer mediaSigner
+}
+
+// mediaSigner grants access to private media by signing its URL. URLs are
+// only signed for the requests that fetch media and right before dispatch,
+// so signed URLs never end up in outcomes or problems. URLs refuse finds
+// fault with are rejected along with those failing the URL policy.
+type mediaSigner interface {
+	refuse(rawURL string) string
+	sign(rawURL string) (string, error)
+}
+
+// reference is how outcomes and problems refer to media: by its object or,
+// without one, by its URL stripped of the query, which may carry credentials.
+func (m *Media) reference() string {
+	if m.Object != "" {
+		return m.Object
+	}
+	return withoutQuery(m.URL)
+}
+
+// signedURL returns the URL the media can be fetched with.
+func (m *Media) signedURL() (string, error) {
+	if m.signer == nil {
+		return m.URL, nil
+	}
+	return m.signer.sign(m.URL)
+}
+
+// signMedia signs the URLs of media that is about to be dispatched.
+func signMedia(media []Media) ([]Media, error) {
+	signed := make([]Media, 0, len(media))
+	for _, m := range media {
+		u, err := m.signedURL()
+		if err != nil {
+			return nil, err
+		}
+		if m.Probe != nil {
+			p := *m.Probe
+			p.URL = u
+			m.Probe = &p
+		}
+		m.URL = u
+		signed = append(signed, m)
+	}
+	return signed, nil
+}
+
+func withoutQuery(rawURL string) string {
+	return strings.SplitN(rawURL, "?", 2)[0]
+}
+
+// MediaAdapter turns events of a storage provider into media references.
+type MediaAdapter interface {
+	Media(ce *CloudEvent) ([]Media, error)
+}
+
+// MediaAdapterFunc allows an ordinary function to be used as a MediaAdapter.
+type MediaAdapterFunc func(ce *CloudEvent) ([]Media, error)
+
+func (f MediaAdapterFunc) Media(ce *CloudEvent) ([]Media, error) {
+	return f(ce)
+}
+
+// UnsupportedEventError is returned when no adapter is registered
+// for the type and source of an event.
+type UnsupportedEventError struct {
+	EventType string
+	Source    string
+}
+
+func (e *UnsupportedEventError) Error() string {
+	return fmt.Sprintf("unsupported event of type '%s' from source '%s'", e.EventType, e.Source)
+}
+
+type adapterRegistration struct {
+	typePattern   string
+	sourcePattern string
+	adapter       MediaAdapter
+}
+
+var (
+	adaptersMu sync.RWMutex
+	adapters   []adapterRegistration
+
+	nativeDecodersMu sync.RWMutex
+	nativeDecoders   []NativeDecoder
+)
+
+// NativeDecoder turns a payload a provider delivers in its own format,
+// rather than as a CloudEvent, into events. ok is false when
+// the payload is not in the decoder's format.
+type NativeDecoder func(body []byte) (events []*CloudEvent, ok bool, err error)
+
+// RegisterNativeDecoder adds a decoder consulted for structured
+// payloads before they are decoded as CloudEvents.
+func RegisterNativeDecoder(d NativeDecoder) {
+	nativeDecodersMu.Lock()
+	defer nativeDecodersMu.Unlock()
+	nativeDecoders = append(nativeDecoders, d)
+}
+
+func decodeNative(body []byte) ([]*CloudEvent, bool, error) {
+	nativeDecodersMu.RLock()
+	defer nativeDecodersMu.RUnlock()
+	for _, d := range nativeDecoders {
+		events, ok, err := d(body)
+		if ok || err != nil {
+			return events, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// Handshake answers a control event, such as a subscription validation,
+// which must be responded to rather than dispatched.
+type Handshake func(ce *CloudEvent) (response interface{}, err error)
+
+type handshakeRegistration struct {
+	typePattern string
+	handshake   Handshake
+}
+
+var (
+	handshakesMu sync.RWMutex
+	handshakes   []handshakeRegistration
+)
+
+// RegisterHandshake makes a handshake responsible for the events
+// whose type matches the pattern.
+func RegisterHandshake(typePattern string, h Handshake) {
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+	handshakes = append(handshakes, handshakeRegistration{typePattern: typePattern, handshake: h})
+}
+
+// LookupHandshake returns the handshake registered for the event, if any.
+func LookupHandshake(ce *CloudEvent) (Handshake, bool) {
+	handshakesMu.RLock()
+	defer handshakesMu.RUnlock()
+	for _, r := range handshakes {
+		if globMatch(r.typePattern, ce.EventType) {
+			return r.handshake, true
+		}
+	}
+	return nil, false
+}
+
+// RegisterAdapter makes an adapter responsible for the events whose type and
+// source match the given patterns. A '*' in a pattern matches any sequence of
+// characters and an empty source pattern matches any source.
+// Adapters are consulted in registration order, the first match wins.
+// Providers are expected to register from an init function of their own file.
+func RegisterAdapter(typePattern, sourcePattern string, adapter MediaAdapter) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	adapters = append(adapters, adapterRegistration{
+		typePattern:   typePattern,
+		sourcePattern: sourcePattern,
+		adapter:       adapter,
+	})
+}
+
+// LookupAdapter finds the adapter registered for the event,
+// falling back to the mappings of the config.
+func LookupAdapter(ce *CloudEvent) (MediaAdapter, error) {
+	if adapter := lookupRegisteredAdapter(ce); adapter != nil {
+		return adapter, nil
+	}
+	ms, err := getMappings()
+	if err != nil {
+		return nil, err
+	}
+	if m := ms.lookup(ce); m != nil {
+		return m, nil
+	}
+	return nil, &UnsupportedEventError{EventType: ce.EventType, Source: ce.Source}
+}
+
+func lookupRegisteredAdapter(ce *CloudEvent) MediaAdapter {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	for _, r := range adapters {
+		if !globMatch(r.typePattern, ce.EventType) {
+			continue
+		}
+		if r.sourcePattern != "" && !globMatch(r.sourcePattern, ce.Source) {
+			continue
+		}
+		return r.adapter
+	}
+	return nil
+}
+
+// GetMedia returns the media references of an event
+// using the adapter registered for it.
+func GetMedia(ce *CloudEvent) ([]Media, error) {
+	adapter, err := LookupAdapter(ce)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.Media(ce)
+}
+
+// globMatch reports whether s matches pattern,
+// where '*' matches any (possibly empty) sequence of characters.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
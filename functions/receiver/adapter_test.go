@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	testSuites := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"aws.s3.object.created", "aws.s3.object.created", true},
+		{"aws.s3.object.created", "aws.s3.object.created.v2", false},
+		{"aws.s3.*", "aws.s3.object.created", true},
+		{"*.created", "aws.s3.object.created", true},
+		{"*", "", true},
+		{"/subscriptions/*/storageAccounts/*#*", "/subscriptions/a/storageAccounts/b#/blobs/c", true},
+		{"/subscriptions/*/storageAccounts/*#*", "/subscriptions/a/blobs/c", false},
+		{"a*b*a", "aba", true},
+		{"a*b*a", "ab", false},
+	}
+	for _, ts := range testSuites {
+		if globMatch(ts.pattern, ts.s) != ts.match {
+			t.Fatalf("globMatch(%q, %q) mismatch!"+
+				"\n\tExpected: %v"+
+				"\n\tActual: %v", ts.pattern, ts.s, ts.match, !ts.match)
+		}
+	}
+}
+
+func TestRegisterAdapter(t *testing.T) {
+	RegisterAdapter("com.example.upload", "https://cms.example.com/*",
+		MediaAdapterFunc(func(ce *CloudEvent) ([]Media, error) {
+			return []Media{{URL: "https://cms.example.com/media/" + ce.Subject}}, nil
+		}))
+
+	ce := &CloudEvent{
+		EventType: "com.example.upload",
+		Source:    "https://cms.example.com/site-a",
+		Subject:   "cat.jpg",
+	}
+	media, err := GetMedia(ce)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(media) != 1 || media[0].URL != "https://cms.example.com/media/cat.jpg" {
+		t.Fatalf("unexpected media: %v", media)
+	}
+
+	ce.Source = "https://elsewhere.example.com"
+	_, err = GetMedia(ce)
+	if _, ok := err.(*UnsupportedEventError); !ok {
+		t.Fatalf("Expected *UnsupportedEventError, got: %v", err)
+	}
+	if statusCode(err) != 422 {
+		t.Fatalf("Unsupported events must be rejected with 422, got: %v", statusCode(err))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthError is returned when the caller of the receiver could not be
+// authenticated, with 401 for missing and 403 for wrong credentials.
+type AuthError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *AuthError) Error() string {
+	return "unauthenticated request: " + e.Reason
+}
+
+// errNoCredentials tells that a request carries no credentials
+// an authenticator understands.
+var errNoCredentials = errors.New("no credentials")
+
+// InboundRequest is what an authenticator gets to see of a request.
+type InboundRequest struct {
+	Header http.Header
+	URL    string
+	Body   []byte
+}
+
+// Authenticator verifies the caller of the receiver. It returns
+// errNoCredentials when the request carries none of its kind,
+// any other error rejects the request.
+type Authenticator interface {
+	Authenticate(r *InboundRequest) error
+}
+
+var (
+	authenticatorsMu sync.RWMutex
+	authenticators   []Authenticator
+)
+
+// RegisterAuthenticator adds an authenticator to the configured ones.
+func RegisterAuthenticator(a Authenticator) {
+	authenticatorsMu.Lock()
+	defer authenticatorsMu.Unlock()
+	authenticators = append(authenticators, a)
+}
+
+// authenticatorsFromConfig returns the authenticators enabled through
+// AUTH_HMAC_SECRETS and AUTH_BEARER_TOKENS along with the registered ones.
+func authenticatorsFromConfig() []Authenticator {
+	var as []Authenticator
+	if secrets := listFromConfig("AUTH_HMAC_SECRETS"); len(secrets) > 0 {
+		as = append(as, &HMACAuthenticator{
+			Secrets:   secrets,
+			Header:    withDefault("AUTH_HMAC_HEADER", "X-Signature"),
+			Tolerance: durationWithDefault("AUTH_HMAC_TOLERANCE", 5*time.Minute),
+		})
+	}
+	if tokens := listFromConfig("AUTH_BEARER_TOKENS"); len(tokens) > 0 {
+		as = append(as, &BearerAuthenticator{Tokens: tokens})
+	}
+
+	authenticatorsMu.RLock()
+	defer authenticatorsMu.RUnlock()
+	return append(as, authenticators...)
+}
+
+// authenticate lets a request through if any of the authenticators accepts
+// it. Without authenticators every request is let through.
+func authenticate(as []Authenticator, r *InboundRequest) error {
+	if len(as) == 0 {
+		return nil
+	}
+	var rejection error
+	for _, a := range as {
+		err := a.Authenticate(r)
+		if err == nil {
+			return nil
+		}
+		if err != errNoCredentials && rejection == nil {
+			rejection = err
+		}
+	}
+	if rejection != nil {
+		return &AuthError{StatusCode: http.StatusForbidden, Reason: rejection.Error()}
+	}
+	return &AuthError{StatusCode: http.StatusUnauthorized, Reason: "no credentials"}
+}
+
+// HMACAuthenticator verifies a signature of the body made with a shared
+// secret, in either of the common forms of the signature header:
+//
+//   - t=<unix time>,v1=<hex signature> over "<t>.<body>", as sent by Stripe,
+//     the time must be within the tolerance
+//   - sha256=<hex signature> over the body, as sent by GitHub
+//
+// Several secrets may be accepted at once, to rotate them.
+type HMACAuthenticator struct {
+	Secrets   []string
+	Header    string
+	Tolerance time.Duration
+
+	now func() time.Time
+}
+
+func (a *HMACAuthenticator) Authenticate(r *InboundRequest) error {
+	v := r.Header.Get(a.Header)
+	if v == "" {
+		return errNoCredentials
+	}
+
+	if strings.HasPrefix(v, "sha256=") {
+		return a.verify(r.Body, []string{strings.TrimPrefix(v, "sha256=")})
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("malformed %s header", a.Header)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed %s timestamp", a.Header)
+	}
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	if d := now().Sub(time.Unix(seconds, 0)); d > a.Tolerance || d < -a.Tolerance {
+		return fmt.Errorf("signature timestamp is outside the tolerance of %s", a.Tolerance)
+	}
+	return a.verify(append([]byte(timestamp+"."), r.Body...), signatures)
+}
+
+func (a *HMACAuthenticator) verify(payload []byte, signatures []string) error {
+	for _, secret := range a.Secrets {
+		expected := hmacSHA256([]byte(secret), string(payload))
+		for _, s := range signatures {
+			if actual, err := hex.DecodeString(s); err == nil && hmac.Equal(actual, expected) {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// BearerAuthenticator accepts static tokens, sent the way the CloudEvents
+// webhook spec has it: as "Authorization: Bearer <token>" or, for senders
+// that cannot set headers, as the access_token query parameter.
+type BearerAuthenticator struct {
+	Tokens []string
+}
+
+func (a *BearerAuthenticator) Authenticate(r *InboundRequest) error {
+	var token string
+	if v := r.Header.Get("Authorization"); v != "" {
+		parts := strings.SplitN(v, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return errNoCredentials
+		}
+		token = strings.TrimSpace(parts[1])
+	} else if u, err := url.Parse(r.URL); err == nil {
+		token = u.Query().Get("access_token")
+	}
+	if token == "" {
+		return errNoCredentials
+	}
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return errors.New("unknown bearer token")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sign(secret, payload string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(payload))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestAuthenticate(t *testing.T) {
+	body := `{"specversion": "1.0"}`
+	signedAt := time.Unix(1600000000, 0)
+	as := []Authenticator{
+		&HMACAuthenticator{
+			Secrets:   []string{"old-secret", "secret"},
+			Header:    "X-Signature",
+			Tolerance: 5 * time.Minute,
+			now:       func() time.Time { return signedAt.Add(time.Minute) },
+		},
+		&BearerAuthenticator{Tokens: []string{"token"}},
+	}
+
+	testSuites := []struct {
+		name   string
+		header http.Header
+		url    string
+		status int
+	}{
+		{"stripe", http.Header{"X-Signature": {fmt.Sprintf("t=1600000000,v1=%s", sign("secret", "1600000000."+body))}}, "", 0},
+		{"stripe-rotated", http.Header{"X-Signature": {fmt.Sprintf("t=1600000000,v1=00,v1=%s", sign("old-secret", "1600000000."+body))}}, "", 0},
+		{"github", http.Header{"X-Signature": {"sha256=" + sign("secret", body)}}, "", 0},
+		{"bearer", http.Header{"Authorization": {"Bearer token"}}, "", 0},
+		{"access-token", http.Header{}, "http://localhost:8080/t/cloudevents/receiver?access_token=token", 0},
+		{"none", http.Header{}, "http://localhost:8080/t/cloudevents/receiver", http.StatusUnauthorized},
+		{"basic", http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, "", http.StatusUnauthorized},
+		{"wrong-token", http.Header{"Authorization": {"Bearer nope"}}, "", http.StatusForbidden},
+		{"wrong-secret", http.Header{"X-Signature": {"sha256=" + sign("nope", body)}}, "", http.StatusForbidden},
+		{"tampered", http.Header{"X-Signature": {fmt.Sprintf("t=1600000001,v1=%s", sign("secret", "1600000000."+body))}}, "", http.StatusForbidden},
+		{"stale", http.Header{"X-Signature": {fmt.Sprintf("t=1599999000,v1=%s", sign("secret", "1599999000."+body))}}, "", http.StatusForbidden},
+		{"malformed", http.Header{"X-Signature": {"v1=abc"}}, "", http.StatusForbidden},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			err := authenticate(as, &InboundRequest{Header: ts.header, URL: ts.url, Body: []byte(body)})
+			status := 0
+			if err != nil {
+				status = statusCode(err)
+			}
+			if status != ts.status {
+				t.Fatalf("Status mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v (%v)", ts.status, status, err)
+			}
+		})
+	}
+}
+
+func TestMyHandlerAuthentication(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	os.Setenv("AUTH_BEARER_TOKENS", "token, other-token")
+	defer os.Unsetenv("AUTH_BEARER_TOKENS")
+
+	// not even a CloudEvent, authentication comes before parsing
+	_, err := myHandler(testContext(nil), strings.NewReader("not an event"))
+	if e, ok := err.(*AuthError); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 *AuthError, got: %v", err)
+	}
+
+	in, err := os.Open("payloads/aws.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+	_, err = myHandler(testContext(http.Header{"Authorization": {"Bearer other-token"}}), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(d.bodies) != 1 {
+		t.Fatalf("Expected exactly one dispatch, got: %v", len(d.bodies))
+	}
+}
@@ -3,36 +3,274 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
+func init() {
+	RegisterAdapter("aws.s3.object.created", "", MediaAdapterFunc(ParseAWSData))
+	RegisterAdapter("aws.s3.object.deleted", "", MediaAdapterFunc(ParseAWSData))
+	RegisterNativeDecoder(DecodeS3Notification)
+	RegisterMediaHosts("aws.s3.object.created", s3Hosts)
+}
+
+// s3Hosts are the hosts S3 media URLs point at, those of S3_ENDPOINT if set.
+func s3Hosts() []string {
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		hosts := hostOf(endpoint)
+		if len(hosts) == 1 {
+			hosts = append(hosts, "*."+hosts[0])
+		}
+		return hosts
+	}
+	return []string{"*.amazonaws.com"}
+}
+
 type AWSBucket struct {
 	Name string `json:"name"`
+	ARN  string `json:"arn"`
 }
 
 type AWSObject struct {
-	Key string `json:"key"`
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	VersionID string `json:"versionId"`
+	ETag      string `json:"eTag"`
+	Sequencer string `json:"sequencer"`
 }
 
 type AWSData struct {
 	S3SchemaVersion string    `json:"s3SchemaVersion"`
 	ConfigurationID string    `json:"configurationId"`
+	AWSRegion       string    `json:"awsRegion"`
 	Bucket          AWSBucket `json:"bucket"`
 	Object          AWSObject `json:"object"`
 }
 
-func ParseAWSData(ceData interface{}) (*string, error) {
-	b, err := json.Marshal(ceData)
+// S3EventRecord is a single record of a native S3 event notification.
+type S3EventRecord struct {
+	EventVersion     string            `json:"eventVersion"`
+	EventSource      string            `json:"eventSource"`
+	AWSRegion        string            `json:"awsRegion"`
+	EventTime        time.Time         `json:"eventTime"`
+	EventName        string            `json:"eventName"`
+	ResponseElements map[string]string `json:"responseElements"`
+	S3               AWSData           `json:"s3"`
+}
+
+// S3Notification is the payload S3 delivers natively,
+// a single notification may reference several objects.
+type S3Notification struct {
+	Records []S3EventRecord `json:"Records"`
+}
+
+func (r *S3EventRecord) created() bool {
+	return strings.HasPrefix(r.EventName, "ObjectCreated:")
+}
+
+func (r *S3EventRecord) removed() bool {
+	return strings.HasPrefix(r.EventName, "ObjectRemoved:")
+}
+
+// DecodeS3Notification recognizes S3 notifications delivered as is
+// and wraps them into an "aws.s3.object.created" event, or an
+// "aws.s3.object.deleted" one when all of its records are removals.
+func DecodeS3Notification(body []byte) ([]*CloudEvent, bool, error) {
+	var n S3Notification
+	if err := json.Unmarshal(body, &n); err != nil || len(n.Records) == 0 {
+		return nil, false, nil
+	}
+	first := n.Records[0]
+	if first.EventSource != "aws:s3" {
+		return nil, false, nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, true, err
+	}
+	id := first.ResponseElements["x-amz-request-id"]
+	if id == "" {
+		id = first.S3.Object.Sequencer
+	}
+	eventType := "aws.s3.object.deleted"
+	for _, r := range n.Records {
+		if !r.removed() {
+			eventType = "aws.s3.object.created"
+		}
+	}
+	return []*CloudEvent{{
+		CloudEventsVersion: "1.0",
+		EventID:            id,
+		Source:             first.S3.Bucket.ARN,
+		EventType:          eventType,
+		EventTime:          first.EventTime,
+		ContentType:        "application/json",
+		Subject:            first.S3.Object.Key,
+		Extensions:         map[string]interface{}{"awsregion": first.AWSRegion},
+		Data:               data,
+	}}, true, nil
+}
+
+const (
+	s3PathStyle    = "path"
+	s3VirtualStyle = "virtual"
+)
+
+// s3Region picks the region of the bucket: the one the notification names,
+// an "awsregion" extension, the AWS_REGION config and finally us-east-1.
+func s3Region(ce *CloudEvent, d *AWSData) string {
+	if d.AWSRegion != "" {
+		return d.AWSRegion
+	}
+	if region, ok := ce.Extensions["awsregion"].(string); ok && region != "" {
+		return region
+	}
+	return withDefault("AWS_REGION", "us-east-1")
+}
+
+// awsURIEncode escapes s the way AWS expects it in canonical URIs:
+// everything except unreserved characters is percent-encoded,
+// slashes are kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ObjectURL builds the URL of an object for the configured endpoint style.
+// S3_ENDPOINT points the URL at an S3-compatible store such as MinIO or Ceph,
+// S3_URL_STYLE picks between path-style (default) and virtual-hosted URLs.
+// Buckets with dots in their names are always addressed path-style,
+// as they do not match the wildcard certificate of virtual hosts.
+func s3ObjectURL(region, bucket, key, versionID string) (string, error) {
+	style := withDefault("S3_URL_STYLE", s3PathStyle)
+	if style != s3PathStyle && style != s3VirtualStyle {
+		return "", fmt.Errorf("unknown S3_URL_STYLE '%s', expected '%s' or '%s'",
+			style, s3PathStyle, s3VirtualStyle)
+	}
+
+	u := &url.URL{Scheme: "https"}
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return "", fmt.Errorf("invalid S3_ENDPOINT '%s'", endpoint)
+		}
+		u.Scheme = e.Scheme
+		u.Host = e.Host
+	} else if region == "us-east-1" {
+		u.Host = "s3.amazonaws.com"
+	} else {
+		u.Host = fmt.Sprintf("s3.%s.amazonaws.com", region)
+	}
+
+	escapedKey := awsURIEncode(key, false)
+	if style == s3VirtualStyle && !strings.Contains(bucket, ".") {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	} else {
+		u.Path = "/" + bucket + "/" + key
+		u.RawPath = "/" + awsURIEncode(bucket, true) + "/" + escapedKey
+	}
+	if versionID != "" {
+		u.RawQuery = "versionId=" + awsURIEncode(versionID, true)
+	}
+
+	return u.String(), nil
+}
+
+// ParseAWSData accepts both the "s3" entity of a single record and a full
+// S3 notification as event data. Every object created or removed by the
+// notification becomes a media reference, removed ones are deleted media.
+func ParseAWSData(ce *CloudEvent) ([]Media, error) {
+	b, err := json.Marshal(ce.Data)
 	if err != nil {
 		return nil, err
 	}
 
-	var d AWSData
-	err = json.Unmarshal(b, &d)
+	var n S3Notification
+	err = json.Unmarshal(b, &n)
 	if err != nil {
 		return nil, err
 	}
+	if len(n.Records) == 0 {
+		var d AWSData
+		err = json.Unmarshal(b, &d)
+		if err != nil {
+			return nil, err
+		}
+		eventName := "ObjectCreated:*"
+		if ce.EventType == "aws.s3.object.deleted" {
+			eventName = "ObjectRemoved:*"
+		}
+		n.Records = []S3EventRecord{{EventName: eventName, AWSRegion: d.AWSRegion, S3: d}}
+	}
 
-	imgURL := fmt.Sprintf("https://s3.amazonaws.com/%s/%s", d.Bucket.Name, d.Object.Key)
+	var media []Media
+	for _, r := range n.Records {
+		if !r.created() && !r.removed() {
+			log.Printf("skipping S3 record '%s' of object '%s'\n", r.EventName, r.S3.Object.Key)
+			continue
+		}
+		m, err := s3Media(ce, &r)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, *m)
+	}
+	if len(media) == 0 {
+		return nil, &UnsupportedEventError{EventType: n.Records[0].EventName, Source: ce.Source}
+	}
+
+	return media, nil
+}
 
-	return &imgURL, nil
+func s3Media(ce *CloudEvent, r *S3EventRecord) (*Media, error) {
+	d := r.S3
+	if d.AWSRegion == "" {
+		d.AWSRegion = r.AWSRegion
+	}
+
+	// S3 delivers keys form-encoded, spaces arrive as '+'
+	key, err := url.QueryUnescape(d.Object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 object key '%s': %s", d.Object.Key, err.Error())
+	}
+
+	region := s3Region(ce, &d)
+	imgURL, err := s3ObjectURL(region, d.Bucket.Name, key, d.Object.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	m := &Media{
+		URL:       imgURL,
+		Size:      d.Object.Size,
+		Object:    "s3://" + d.Bucket.Name + "/" + key,
+		ETag:      d.Object.ETag,
+		Sequencer: d.Object.Sequencer,
+		Deleted:   r.removed(),
+	}
+	// there is nothing left to fetch of removed objects
+	if !m.Deleted {
+		m.signer, err = s3SignerFromConfig(region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
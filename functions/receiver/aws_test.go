@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseAWSData(t *testing.T) {
+	ce := loadCloudEvent(t, "payloads/aws.versioned.payload.json")
+	media, err := GetMedia(ce)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "https://s3.eu-west-1.amazonaws.com/cloudevents/photos/dan%20kohn%20%281%29.jpg" +
+		"?versionId=3HL4kqtJlcpXroDTDmJ%2BrmSpXd3dIbrHY"
+	if len(media) != 1 || media[0].URL != expected {
+		t.Fatalf("Media mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, media)
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	defer os.Unsetenv("S3_ENDPOINT")
+	defer os.Unsetenv("S3_URL_STYLE")
+
+	testSuites := []struct {
+		name     string
+		endpoint string
+		style    string
+		region   string
+		bucket   string
+		imageURL string
+	}{
+		{"path-us-east-1", "", "", "us-east-1", "cloudevents",
+			"https://s3.amazonaws.com/cloudevents/a%20b/c.jpg"},
+		{"path-regional", "", "path", "eu-west-1", "cloudevents",
+			"https://s3.eu-west-1.amazonaws.com/cloudevents/a%20b/c.jpg"},
+		{"virtual-regional", "", "virtual", "eu-west-1", "cloudevents",
+			"https://cloudevents.s3.eu-west-1.amazonaws.com/a%20b/c.jpg"},
+		{"virtual-dotted-bucket", "", "virtual", "eu-west-1", "cloud.events",
+			"https://s3.eu-west-1.amazonaws.com/cloud.events/a%20b/c.jpg"},
+		{"custom-path", "http://minio.local:9000", "", "us-east-1", "cloudevents",
+			"http://minio.local:9000/cloudevents/a%20b/c.jpg"},
+		{"custom-virtual", "https://ceph.example.com", "virtual", "us-east-1", "cloudevents",
+			"https://cloudevents.ceph.example.com/a%20b/c.jpg"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			os.Setenv("S3_ENDPOINT", ts.endpoint)
+			os.Setenv("S3_URL_STYLE", ts.style)
+			imgURL, err := s3ObjectURL(ts.region, ts.bucket, "a b/c.jpg", "")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if imgURL != ts.imageURL {
+				t.Fatalf("Object URL mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.imageURL, imgURL)
+			}
+		})
+	}
+
+	t.Run("unknown-style", func(t *testing.T) {
+		os.Setenv("S3_ENDPOINT", "")
+		os.Setenv("S3_URL_STYLE", "dns")
+		if _, err := s3ObjectURL("us-east-1", "b", "k", ""); err == nil {
+			t.Fatal("expected an error for an unknown S3_URL_STYLE")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// azureSASVersion is the storage service version the
+	// string-to-sign of azureBlobStringToSign is laid out for.
+	azureSASVersion    = "2020-12-06"
+	azureSASTimeFormat = "2006-01-02T15:04:05Z"
+
+	// azureBlobHostSuffix follows the account in the host of every blob URL.
+	azureBlobHostSuffix = ".blob.core.windows.net"
+
+	// azureSASClockSkew backdates the start of a SAS,
+	// so clocks that are slightly off do not reject it.
+	azureSASClockSkew = 5 * time.Minute
+)
+
+// AzureBlobSAS is a read-only service SAS of a single blob.
+type AzureBlobSAS struct {
+	Account   string
+	Container string
+	Blob      string
+	Start     time.Time
+	Expiry    time.Time
+}
+
+// stringToSign lays the fields of the SAS out the way the storage service
+// expects for azureSASVersion, unused fields are left empty.
+func (s *AzureBlobSAS) stringToSign() string {
+	return strings.Join([]string{
+		"r", // signedPermissions
+		s.Start.UTC().Format(azureSASTimeFormat),
+		s.Expiry.UTC().Format(azureSASTimeFormat),
+		"/blob/" + s.Account + "/" + s.Container + "/" + s.Blob,
+		"",      // signedIdentifier
+		"",      // signedIP
+		"https", // signedProtocol
+		azureSASVersion,
+		"b", // signedResource
+		"",  // signedSnapshotTime
+		"",  // signedEncryptionScope
+		"",  // rscc
+		"",  // rscd
+		"",  // rsce
+		"",  // rscl
+		"",  // rsct
+	}, "\n")
+}
+
+// Query signs the SAS with the storage account key
+// and returns it as query parameters.
+func (s *AzureBlobSAS) Query(key []byte) url.Values {
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, s.stringToSign()))
+	return url.Values{
+		"sv":  {azureSASVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"st":  {s.Start.UTC().Format(azureSASTimeFormat)},
+		"se":  {s.Expiry.UTC().Format(azureSASTimeFormat)},
+		"spr": {"https"},
+		"sig": {signature},
+	}
+}
+
+// azureBlobAccount returns the storage account of a blob URL, whose
+// host must be <account>.blob.core.windows.net exactly.
+func azureBlobAccount(u *url.URL) (string, bool) {
+	host := strings.ToLower(u.Hostname())
+	account := strings.TrimSuffix(host, azureBlobHostSuffix)
+	if u.Scheme != "https" || account == host || account == "" || strings.Contains(account, ".") {
+		return "", false
+	}
+	return account, true
+}
+
+// AzureBlobSASURL appends a read-only SAS, valid from t for the given duration,
+// to the URL of a blob. The account is taken from the blob host.
+func AzureBlobSASURL(rawURL string, key []byte, t time.Time, expires time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	account, ok := azureBlobAccount(u)
+	path := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if !ok || len(path) != 2 || path[0] == "" || path[1] == "" {
+		return "", fmt.Errorf("unable to sign '%s': not the URL of a blob", withoutQuery(rawURL))
+	}
+
+	sas := &AzureBlobSAS{
+		Account:   account,
+		Container: path[0],
+		Blob:      path[1],
+		Start:     t.Add(-azureSASClockSkew),
+		Expiry:    t.Add(expires),
+	}
+	query := u.Query()
+	for name, values := range sas.Query(key) {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// azureSigner appends a SAS valid for AZURE_SAS_EXPIRY (15m by default)
+// to Azure media URLs of the account, any account if empty.
+type azureSigner struct {
+	key     []byte
+	account string
+}
+
+// azureSignerFromConfig returns the signer of blobs, nil unless AZURE_SAS
+// is enabled. The key of the storage account is the base64 AZURE_STORAGE_KEY.
+func azureSignerFromConfig() (mediaSigner, error) {
+	if withDefault("AZURE_SAS", "false") != "true" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("unable to sign Azure media URLs: AZURE_STORAGE_KEY is not a base64 account key")
+	}
+	return azureSigner{key: key, account: os.Getenv("AZURE_STORAGE_ACCOUNT")}, nil
+}
+
+// refuse keeps the key from signing URLs that are no blob URLs or blobs of
+// other accounts than AZURE_STORAGE_ACCOUNT, if set.
+func (s azureSigner) refuse(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid URL"
+	}
+	account, ok := azureBlobAccount(u)
+	if !ok {
+		return "not the URL of a blob"
+	}
+	if s.account != "" && !strings.EqualFold(account, s.account) {
+		return fmt.Sprintf("blob is not stored in account '%s'", s.account)
+	}
+	return ""
+}
+
+func (s azureSigner) sign(rawURL string) (string, error) {
+	expires := durationWithDefault("AZURE_SAS_EXPIRY", 15*time.Minute)
+	return AzureBlobSASURL(rawURL, s.key, time.Now(), expires)
+}
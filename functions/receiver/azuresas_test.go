@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// devStoreKey is the publicly documented account key of the storage emulator.
+const devStoreKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// The expected queries below were produced by Microsoft's own implementation
+// of the service SAS, sas.BlobSignatureValues.SignWithSharedKey of the Azure SDK
+// for Go (sdk/storage/azblob v1.6.3), with version 2020-12-06, HTTPS only and
+// read permission, rather than by the code under test.
+func TestAzureBlobSAS(t *testing.T) {
+	tests := []struct {
+		url      string
+		key      string
+		signedAt string
+		expires  time.Duration
+		expected string
+	}{
+		{
+			url:      "https://myaccount.blob.core.windows.net/pictures/profile%20pic.jpg",
+			key:      devStoreKey,
+			signedAt: "2013-08-16T00:00:00Z",
+			expires:  5 * time.Minute,
+			expected: "se=2013-08-16T00%3A05%3A00Z&sig=0O3bxsdPIUxicB5J884eraahDpd3AxSH5O7zPTgotqw%3D&sp=r&spr=https" +
+				"&sr=b&st=2013-08-15T23%3A55%3A00Z&sv=2020-12-06",
+		},
+		{
+			url:      "https://myaccount.blob.core.windows.net/mycontainer/photos/dan%20kohn.jpg",
+			key:      base64.StdEncoding.EncodeToString([]byte("receiver-test-account-key")),
+			signedAt: "2021-06-01T12:00:00Z",
+			expires:  15 * time.Minute,
+			expected: "se=2021-06-01T12%3A15%3A00Z&sig=Q5p6VXhemh%2BQLKvkzYc9Yo3jj%2FiXH50rC8zB5GfebQM%3D&sp=r&spr=https" +
+				"&sr=b&st=2021-06-01T11%3A55%3A00Z&sv=2020-12-06",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.url, func(t *testing.T) {
+			signedAt, _ := time.Parse(azureSASTimeFormat, ts.signedAt)
+			key, _ := base64.StdEncoding.DecodeString(ts.key)
+
+			signed, err := AzureBlobSASURL(ts.url, key, signedAt, ts.expires)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if u.RawQuery != ts.expected {
+				t.Fatalf("SAS mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.expected, u.RawQuery)
+			}
+		})
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(devStoreKey)
+	for _, u := range []string{
+		"https://myaccount.blob.core.windows.net/pictures",
+		"https://myaccount.evil.example/pictures/secret.jpg",
+		"https://myaccount.blob.core.windows.net.evil.example/pictures/secret.jpg",
+		"https://a.myaccount.blob.core.windows.net/pictures/secret.jpg",
+		"http://myaccount.blob.core.windows.net/pictures/secret.jpg",
+	} {
+		if _, err := AzureBlobSASURL(u, key, time.Now(), time.Minute); err == nil {
+			t.Fatalf("expected an error for '%s', which is not the URL of a blob", u)
+		}
+	}
+}
+
+func TestAzureSASMedia(t *testing.T) {
+	for k, v := range map[string]string{
+		"AZURE_SAS":             "true",
+		"AZURE_STORAGE_ACCOUNT": "cvtest34",
+		"AZURE_STORAGE_KEY":     devStoreKey,
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	media, err := GetMedia(loadCloudEvent(t, "payloads/azure.payload.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the adapter leaves the URL as it is, it is signed on dispatch
+	if strings.Contains(media[0].URL, "sig=") {
+		t.Fatalf("Expected the media URL not to be signed yet: %v", media[0].URL)
+	}
+	signed, err := signMedia(media)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	u, err := url.Parse(signed[0].URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if u.Path != "/myfiles/IMG_20180224_0004.jpg" || u.Query().Get("sig") == "" {
+		t.Fatalf("Unexpected signed URL: %v", signed[0].URL)
+	}
+
+	signer := media[0].signer
+	for rawURL, expected := range map[string]string{
+		"https://cvtest34.blob.core.windows.net/myfiles/a.jpg": "",
+		"https://cvtest34.evil.example/private/secret.jpg":     "not the URL of a blob",
+		"https://other.blob.core.windows.net/myfiles/a.jpg":    "blob is not stored in account 'cvtest34'",
+	} {
+		if reason := signer.refuse(rawURL); reason != expected {
+			t.Fatalf("Reason mismatch for %s!"+
+				"\n\tExpected: %v"+
+				"\n\tActual: %v", rawURL, expected, reason)
+		}
+	}
+}
+
+func TestMyHandlerRejectsBlobsOfOtherAccounts(t *testing.T) {
+	for k, v := range map[string]string{
+		"AZURE_SAS":             "true",
+		"AZURE_STORAGE_ACCOUNT": "cvtest34",
+		"AZURE_STORAGE_KEY":     devStoreKey,
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	var events []map[string]interface{}
+	b, err := ioutil.ReadFile("payloads/eventgrid.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := json.Unmarshal(b, &events); err != nil {
+		t.Fatal(err.Error())
+	}
+	var other string
+	for _, e := range events {
+		if e["eventType"] == "Microsoft.Storage.BlobCreated" {
+			data := e["data"].(map[string]interface{})
+			data["url"] = strings.Replace(data["url"].(string), "://", "://other", 1)
+			other = e["id"].(string)
+			break
+		}
+	}
+	b, _ = json.Marshal(events)
+
+	resp, err := myHandler(testContext(nil), bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dispatched := 0
+	for _, outcome := range resp.(*HandlerResponse).Events {
+		switch {
+		case outcome.EventID == other:
+			if outcome.Status != statusRejected || len(outcome.Rejected) != 1 ||
+				strings.Contains(outcome.Rejected[0].URL, "sig=") {
+				t.Fatalf("Expected the blob of the other account to be rejected, got: %v", outcome)
+			}
+		case outcome.Status == statusDispatched:
+			dispatched++
+		}
+	}
+	if dispatched == 0 || len(d.bodies) != dispatched {
+		t.Fatalf("Expected the other events to be dispatched, got: %v", resp)
+	}
+}
@@ -1,28 +1,439 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
+
+	"github.com/fnproject/fdk-go"
 )
 
+// CloudEvent is the receiver's normalized view of an incoming event.
+// Whatever specification version the producer used, the attributes end up
+// in the same fields, so adapters never need to know about attribute names.
 type CloudEvent struct {
-	CloudEventsVersion string      `json:"cloudEventsVersion"`
-	EventID            string      `json:"eventID"`
-	Source             string      `json:"source"`
-	EventType          string      `json:"eventType"`
-	EventTypeVersion   string      `json:"eventTypeVersion"`
-	EventTime          time.Time   `json:"eventTime"`
-	SchemaURL          string      `json:"schemaURL"`
-	ContentType        string      `json:"contentType"`
-	Data               interface{} `json:"data"`
+	CloudEventsVersion string
+	EventID            string
+	Source             string
+	EventType          string
+	EventTypeVersion   string
+	EventTime          time.Time
+	SchemaURL          string
+	ContentType        string
+	Subject            string
+	Extensions         map[string]interface{}
+	Data               interface{}
+}
+
+// specAttributes maps the normalized attributes onto the names
+// a particular specification version uses on the wire.
+type specAttributes struct {
+	version     string
+	id          string
+	source      string
+	eventType   string
+	typeVersion string
+	time        string
+	schema      string
+	contentType string
+	subject     string
+	// dataEncoding is the 0.3 attribute announcing a base64 encoded data.
+	dataEncoding string
+	// dataBase64 is the 1.0 member carrying binary data.
+	dataBase64 string
+	// nestedExtensions is set when extensions live in an "extensions" bag
+	// instead of being top-level attributes.
+	nestedExtensions bool
+}
+
+var specVersions = map[string]specAttributes{
+	"0.1": {
+		version:          "cloudEventsVersion",
+		id:               "eventID",
+		source:           "source",
+		eventType:        "eventType",
+		typeVersion:      "eventTypeVersion",
+		time:             "eventTime",
+		schema:           "schemaURL",
+		contentType:      "contentType",
+		nestedExtensions: true,
+	},
+	"0.2": {
+		version:     "specversion",
+		id:          "id",
+		source:      "source",
+		eventType:   "type",
+		time:        "time",
+		schema:      "schemaurl",
+		contentType: "contenttype",
+	},
+	"0.3": {
+		version:      "specversion",
+		id:           "id",
+		source:       "source",
+		eventType:    "type",
+		time:         "time",
+		schema:       "schemaurl",
+		contentType:  "datacontenttype",
+		subject:      "subject",
+		dataEncoding: "datacontentencoding",
+	},
+	"1.0": {
+		version:     "specversion",
+		id:          "id",
+		source:      "source",
+		eventType:   "type",
+		time:        "time",
+		schema:      "dataschema",
+		contentType: "datacontenttype",
+		subject:     "subject",
+		dataBase64:  "data_base64",
+	},
+}
+
+// known returns true if the attribute name is defined by the spec version
+// and therefore must not be treated as an extension.
+func (s specAttributes) known(name string) bool {
+	if name == "data" || name == "extensions" {
+		return true
+	}
+	for _, a := range []string{s.version, s.id, s.source, s.eventType, s.typeVersion,
+		s.time, s.schema, s.contentType, s.subject, s.dataEncoding, s.dataBase64} {
+		if a != "" && a == name {
+			return true
+		}
+	}
+	return false
+}
+
+type stringAttribute struct {
+	name     string
+	dst      *string
+	required bool
+}
+
+// attributes lists the string attributes of the spec version along with
+// the field of ce each one is decoded into.
+func (s specAttributes) attributes(ce *CloudEvent) []stringAttribute {
+	return []stringAttribute{
+		{s.id, &ce.EventID, true},
+		{s.source, &ce.Source, true},
+		{s.eventType, &ce.EventType, true},
+		{s.typeVersion, &ce.EventTypeVersion, false},
+		{s.schema, &ce.SchemaURL, false},
+		{s.contentType, &ce.ContentType, false},
+		{s.subject, &ce.Subject, false},
+	}
+}
+
+func detectSpecVersion(attrs map[string]json.RawMessage) (string, error) {
+	raw, ok := attrs["specversion"]
+	if !ok {
+		raw, ok = attrs["cloudEventsVersion"]
+	}
+	if !ok {
+		return "", fmt.Errorf("unable to detect CloudEvents spec version: " +
+			"neither 'specversion' nor 'cloudEventsVersion' is set")
+	}
+	var version string
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return "", fmt.Errorf("invalid CloudEvents spec version: %s", raw)
+	}
+	return version, nil
+}
+
+func (ce *CloudEvent) UnmarshalJSON(b []byte) error {
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		return err
+	}
+
+	version, err := detectSpecVersion(attrs)
+	if err != nil {
+		return err
+	}
+	spec, ok := specVersions[version]
+	if !ok {
+		return fmt.Errorf("unsupported CloudEvents spec version: '%s'", version)
+	}
+
+	var e CloudEvent
+	e.CloudEventsVersion = version
+	for _, a := range spec.attributes(&e) {
+		raw, ok := attrs[a.name]
+		if a.name == "" || !ok || string(raw) == "null" {
+			if a.required {
+				return fmt.Errorf("CloudEvent %s is missing required attribute '%s'", version, a.name)
+			}
+			continue
+		}
+		if err := json.Unmarshal(raw, a.dst); err != nil {
+			return fmt.Errorf("CloudEvent attribute '%s' is invalid: %s", a.name, err.Error())
+		}
+	}
+
+	if raw, ok := attrs[spec.time]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &e.EventTime); err != nil {
+			return fmt.Errorf("CloudEvent attribute '%s' is invalid: %s", spec.time, err.Error())
+		}
+	}
+
+	e.Extensions = map[string]interface{}{}
+	if spec.nestedExtensions {
+		if raw, ok := attrs["extensions"]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &e.Extensions); err != nil {
+				return fmt.Errorf("CloudEvent extensions are invalid: %s", err.Error())
+			}
+		}
+	} else {
+		for name, raw := range attrs {
+			if spec.known(name) {
+				continue
+			}
+			var v interface{}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return err
+			}
+			e.Extensions[name] = v
+		}
+	}
+
+	if err := e.decodeData(spec, attrs); err != nil {
+		return err
+	}
+
+	*ce = e
+	return nil
+}
+
+// MarshalJSON encodes the event in the 1.0 structured format,
+// whatever spec version it was received in.
+func (ce *CloudEvent) MarshalJSON() ([]byte, error) {
+	attrs := map[string]interface{}{}
+	for name, v := range ce.Extensions {
+		if !reservedAttributes[name] {
+			attrs[name] = v
+		}
+	}
+	attrs["specversion"] = "1.0"
+	attrs["id"] = ce.EventID
+	attrs["source"] = ce.Source
+	attrs["type"] = ce.EventType
+	for name, v := range map[string]string{
+		"subject":         ce.Subject,
+		"dataschema":      ce.SchemaURL,
+		"datacontenttype": ce.ContentType,
+	} {
+		if v != "" {
+			attrs[name] = v
+		}
+	}
+	if !ce.EventTime.IsZero() {
+		attrs["time"] = ce.EventTime.Format(time.RFC3339Nano)
+	}
+	if b, ok := ce.Data.([]byte); ok {
+		attrs["data_base64"] = base64.StdEncoding.EncodeToString(b)
+	} else if ce.Data != nil {
+		attrs["data"] = ce.Data
+	}
+	return json.Marshal(attrs)
+}
+
+func (ce *CloudEvent) decodeData(spec specAttributes, attrs map[string]json.RawMessage) error {
+	var encoding string
+	if raw, ok := attrs[spec.dataEncoding]; ok && spec.dataEncoding != "" {
+		json.Unmarshal(raw, &encoding)
+	}
+
+	if raw, ok := attrs[spec.dataBase64]; ok && spec.dataBase64 != "" {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("CloudEvent '%s' must be a string", spec.dataBase64)
+		}
+		return ce.setBinaryData(s)
+	}
+
+	raw, ok := attrs["data"]
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	if strings.EqualFold(encoding, "base64") {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("base64 encoded CloudEvent data must be a string")
+		}
+		return ce.setBinaryData(s)
+	}
+	return json.Unmarshal(raw, &ce.Data)
+}
+
+// setBinaryData decodes base64 data and, when the content type says
+// the payload is JSON, turns it into the same shape as inline JSON data.
+func (ce *CloudEvent) setBinaryData(s string) error {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("unable to decode base64 CloudEvent data: %s", err.Error())
+	}
+	if isJSONContentType(ce.ContentType) {
+		return json.Unmarshal(b, &ce.Data)
+	}
+	ce.Data = b
+	return nil
+}
+
+// binaryHeaderPrefix is the prefix of the HTTP headers carrying CloudEvent
+// attributes in binary content mode.
+const binaryHeaderPrefix = "Ce-"
+
+// detectBinarySpecVersion returns the spec version announced by the binary
+// mode headers, or an empty string when the request is not in binary mode.
+func detectBinarySpecVersion(hs http.Header) string {
+	if v := hs.Get(binaryHeaderPrefix + "specversion"); v != "" {
+		return v
+	}
+	return hs.Get(binaryHeaderPrefix + "cloudEventsVersion")
+}
+
+// binaryHeaderValue reads a CloudEvent attribute from a header,
+// undoing the percent-encoding 1.0 producers apply to non-ASCII values.
+func binaryHeaderValue(hs http.Header, key string) string {
+	v := hs.Get(key)
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+// NewBinaryCloudEvent builds a CloudEvent from a request in binary content
+// mode: attributes and extensions come from the ce-* headers, the content
+// type from Content-Type and the data is the request body as is.
+func NewBinaryCloudEvent(hs http.Header, body []byte) (*CloudEvent, error) {
+	version := detectBinarySpecVersion(hs)
+	spec, ok := specVersions[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported CloudEvents spec version: '%s'", version)
+	}
+
+	var e CloudEvent
+	e.CloudEventsVersion = version
+	for _, a := range spec.attributes(&e) {
+		if a.name == "" || a.name == spec.contentType {
+			continue
+		}
+		*a.dst = binaryHeaderValue(hs, binaryHeaderPrefix+a.name)
+		if a.required && *a.dst == "" {
+			return nil, fmt.Errorf("CloudEvent %s is missing required header '%s%s'",
+				version, binaryHeaderPrefix, a.name)
+		}
+	}
+	e.ContentType = hs.Get("Content-Type")
+
+	if v := hs.Get(binaryHeaderPrefix + spec.time); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("CloudEvent header '%s%s' is invalid: %s",
+				binaryHeaderPrefix, spec.time, err.Error())
+		}
+		e.EventTime = t
+	}
+
+	e.Extensions = map[string]interface{}{}
+	for key := range hs {
+		name := strings.ToLower(key)
+		if !strings.HasPrefix(name, "ce-") {
+			continue
+		}
+		name = strings.TrimPrefix(name, "ce-")
+		if spec.nestedExtensions {
+			// 0.1 marks extensions with an additional "X-" prefix
+			if !strings.HasPrefix(name, "x-") {
+				continue
+			}
+			name = strings.TrimPrefix(name, "x-")
+		} else if spec.knownHeader(name) {
+			continue
+		}
+		e.Extensions[name] = binaryHeaderValue(hs, http.CanonicalHeaderKey(key))
+	}
+
+	if len(body) > 0 {
+		if isJSONContentType(e.ContentType) {
+			if err := json.Unmarshal(body, &e.Data); err != nil {
+				return nil, fmt.Errorf("unable to decode binary CloudEvent data: %s", err.Error())
+			}
+		} else {
+			e.Data = body
+		}
+	}
+
+	return &e, nil
+}
+
+// knownHeader is like known, but for the lower-cased names
+// binary mode attributes arrive with.
+func (s specAttributes) knownHeader(name string) bool {
+	for _, a := range []string{s.version, s.id, s.source, s.eventType, s.typeVersion,
+		s.time, s.schema, s.contentType, s.subject} {
+		if a != "" && strings.ToLower(a) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeCloudEvents reads the incoming events in whichever HTTP content mode
+// the sender used. Structured payloads a native decoder recognizes
+// are turned into events by that decoder, which may yield a batch.
+func DecodeCloudEvents(ctx context.Context, in io.Reader) ([]*CloudEvent, error) {
+	body, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := fdk.Context(ctx).Header
+	if detectBinarySpecVersion(hs) != "" {
+		log.Println("CloudEvent is in binary format")
+		ce, err := NewBinaryCloudEvent(hs, body)
+		if err != nil {
+			return nil, err
+		}
+		return []*CloudEvent{ce}, nil
+	}
+
+	events, ok, err := decodeNative(body)
+	if ok || err != nil {
+		return events, err
+	}
+
+	var ce CloudEvent
+	err = json.Unmarshal(body, &ce)
+	if err != nil {
+		return nil, err
+	}
+	return []*CloudEvent{&ce}, nil
 }
 
-func GetImageURL(ce *CloudEvent) (*string, error) {
-	if strings.Contains(ce.EventType, "aws.s3.object.created") {
-		return ParseAWSData(ce.Data)
+// isJSONContentType reports whether data of the given content type is JSON.
+// An absent content type is treated as JSON, as the spec suggests for
+// structured mode.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
 	}
-	if strings.Contains(ce.EventType, "Microsoft.Storage.BlobCreated") {
-		return ParseAzureData(ce.Data)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
 	}
-	return nil, nil
+	return mediaType == "application/json" ||
+		mediaType == "text/json" ||
+		strings.HasSuffix(mediaType, "+json")
 }
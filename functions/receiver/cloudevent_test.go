@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fnproject/fdk-go"
+)
+
+func loadCloudEvent(t *testing.T, path string) *CloudEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	var ce CloudEvent
+	err = json.NewDecoder(f).Decode(&ce)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &ce
+}
+
+func TestCloudEventSpecVersions(t *testing.T) {
+	awsTime, _ := time.Parse(time.RFC3339, "2018-04-26T14:48:09.769Z")
+	azureTime, _ := time.Parse(time.RFC3339, "2018-04-23T12:28:22.4579346Z")
+
+	testSuites := []struct {
+		payload  string
+		version  string
+		id       string
+		time     time.Time
+		imageURL string
+	}{
+		{"payloads/aws.payload.json", "0.1", "C234-1234-1234", awsTime,
+			"https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"},
+		{"payloads/aws.v0.2.payload.json", "0.2", "C234-1234-1234", awsTime,
+			"https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"},
+		{"payloads/aws.v0.3.payload.json", "0.3", "C234-1234-1234", awsTime,
+			"https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"},
+		{"payloads/aws.v1.0.payload.json", "1.0", "C234-1234-1234", awsTime,
+			"https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"},
+		{"payloads/azure.payload.json", "0.1", "96fb5f0b-001e-0108-6dfe-da6e2806f124", azureTime,
+			"https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg"},
+		{"payloads/azure.v1.0.payload.json", "1.0", "96fb5f0b-001e-0108-6dfe-da6e2806f124", azureTime,
+			"https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.payload, func(t *testing.T) {
+			ce := loadCloudEvent(t, ts.payload)
+			if ce.CloudEventsVersion != ts.version {
+				t.Fatalf("Spec version mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.version, ce.CloudEventsVersion)
+			}
+			if ce.EventID != ts.id {
+				t.Fatalf("Event ID mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.id, ce.EventID)
+			}
+			if !ce.EventTime.Equal(ts.time) {
+				t.Fatalf("Event time mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.time, ce.EventTime)
+			}
+
+			media, err := GetMedia(ce)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(media) != 1 || media[0].URL != ts.imageURL {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.imageURL, media)
+			}
+		})
+	}
+}
+
+func TestCloudEventExtensions(t *testing.T) {
+	ce := loadCloudEvent(t, "payloads/aws.v1.0.payload.json")
+	if ce.Extensions["awsregion"] != "us-east-1" {
+		t.Fatalf("Extension mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", "us-east-1", ce.Extensions["awsregion"])
+	}
+	if _, ok := ce.Extensions["subject"]; ok {
+		t.Fatal("'subject' is a 1.0 attribute and must not be treated as an extension")
+	}
+	if ce.Subject != "dan_kohn.jpg" {
+		t.Fatalf("Subject mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", "dan_kohn.jpg", ce.Subject)
+	}
+}
+
+func TestCloudEventInvalid(t *testing.T) {
+	testSuites := map[string]string{
+		"no-version":      `{"type": "t", "id": "1", "source": "s"}`,
+		"unknown-version": `{"specversion": "9.9", "type": "t", "id": "1", "source": "s"}`,
+		"no-type":         `{"specversion": "1.0", "id": "1", "source": "s"}`,
+		"bad-base64":      `{"specversion": "1.0", "type": "t", "id": "1", "source": "s", "data_base64": "%%%"}`,
+	}
+	for name, payload := range testSuites {
+		t.Run(name, func(t *testing.T) {
+			var ce CloudEvent
+			err := json.NewDecoder(strings.NewReader(payload)).Decode(&ce)
+			if err == nil {
+				t.Fatalf("expected an error for payload: %v", payload)
+			}
+		})
+	}
+}
+
+func TestCloudEventBinaryMode(t *testing.T) {
+	structured := loadCloudEvent(t, "payloads/aws.payload.json")
+	body, err := json.Marshal(structured.Data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testSuites := map[string]http.Header{
+		"binary-1.0": {
+			"Content-Type":     {"application/json"},
+			"Ce-Specversion":   {"1.0"},
+			"Ce-Type":          {"aws.s3.object.created"},
+			"Ce-Id":            {"C234-1234-1234"},
+			"Ce-Source":        {"https://serverless.com"},
+			"Ce-Time":          {"2018-04-26T14:48:09.769Z"},
+			"Ce-Subject":       {"dan_kohn.jpg"},
+			"Ce-Awsregion":     {"us-east-1"},
+			"X-Forwarded-Host": {"example.com"},
+		},
+		"binary-0.1": {
+			"Content-Type":          {"application/json"},
+			"Ce-Cloudeventsversion": {"0.1"},
+			"Ce-Eventtype":          {"aws.s3.object.created"},
+			"Ce-Eventid":            {"C234-1234-1234"},
+			"Ce-Source":             {"https://serverless.com"},
+			"Ce-Eventtime":          {"2018-04-26T14:48:09.769Z"},
+			"Ce-X-Awsregion":        {"us-east-1"},
+		},
+	}
+
+	for name, hs := range testSuites {
+		t.Run(name, func(t *testing.T) {
+			ctx := fdk.WithContext(context.Background(), &fdk.Ctx{Header: hs})
+			events, err := DecodeCloudEvents(ctx, bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			ce := events[0]
+			if ce.EventID != structured.EventID || ce.EventType != structured.EventType ||
+				!ce.EventTime.Equal(structured.EventTime) {
+				t.Fatalf("Binary CloudEvent attributes mismatch!"+
+					"\n\tExpected: %+v"+
+					"\n\tActual: %+v", structured, ce)
+			}
+			if len(ce.Extensions) != 1 || ce.Extensions["awsregion"] != "us-east-1" {
+				t.Fatalf("Binary CloudEvent extensions mismatch: %v", ce.Extensions)
+			}
+
+			media, err := GetMedia(ce)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			expected, _ := GetMedia(structured)
+			if !reflect.DeepEqual(media, expected) {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", expected, media)
+			}
+		})
+	}
+
+	t.Run("binary-missing-id", func(t *testing.T) {
+		hs := http.Header{
+			"Ce-Specversion": {"1.0"},
+			"Ce-Type":        {"aws.s3.object.created"},
+			"Ce-Source":      {"https://serverless.com"},
+		}
+		ctx := fdk.WithContext(context.Background(), &fdk.Ctx{Header: hs})
+		_, err := DecodeCloudEvents(ctx, bytes.NewReader(body))
+		if err == nil {
+			t.Fatal("expected an error for a binary CloudEvent without 'ce-id'")
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DeadLetter is what the receiver keeps of an event it was unable to deliver:
+// the request it attempted to make and why it failed. Records are written as
+// JSON lines, so that dead-letter-redrive can replay them. Unsigned tells that
+// the media URLs were signed for the delivery but are kept unsigned.
+type DeadLetter struct {
+	EventID   string      `json:"event_id"`
+	RelatedID string      `json:"related_id"`
+	Target    string      `json:"target"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Unsigned  bool        `json:"unsigned,omitempty"`
+	Reason    string      `json:"reason"`
+	Attempts  int         `json:"attempts"`
+	Time      time.Time   `json:"time"`
+}
+
+// sendToDeadLetter hands the record over to the DEAD_LETTER_SINK, which is
+// one of:
+//
+//   - a file path, optionally as a file:// URL, records are appended to
+//   - an http(s) URL records are POSTed to
+//   - fn:<path> of a function of the receiver's app records are POSTed to
+//
+// Without a sink the record is only logged.
+func sendToDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	sink := os.Getenv("DEAD_LETTER_SINK")
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sink == "":
+		log.Printf("DEAD_LETTER_SINK is not set, dropping event: %s\n", b)
+		return nil
+	case strings.HasPrefix(sink, "http://"), strings.HasPrefix(sink, "https://"):
+		err = postDeadLetter(sink, b)
+	case strings.HasPrefix(sink, "fn:"):
+		err = postDeadLetter(fnTriggerURL(ctx, strings.TrimPrefix(sink, "fn:")), b)
+	default:
+		err = appendDeadLetter(strings.TrimPrefix(sink, "file://"), b)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("event '%s' sent to dead-letter sink '%s'\n", dl.EventID, sink)
+	return nil
+}
+
+func appendDeadLetter(path string, record []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(record, '\n'))
+	return err
+}
+
+// postDeadLetter is not bound to the function deadline, which is likely
+// to be exhausted by the time an event is dead-lettered.
+func postDeadLetter(target string, record []byte) error {
+	client := &http.Client{Timeout: durationWithDefault("DEAD_LETTER_TIMEOUT", 10*time.Second)}
+	resp, err := client.Post(target, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 202 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("dead-letter sink '%s' responded with status %d: %s",
+			target, resp.StatusCode, string(b))
+	}
+	return nil
+}
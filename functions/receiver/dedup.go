@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// duplicatesSuppressed counts the events that were acknowledged
+// without being dispatched because they had been seen before.
+var duplicatesSuppressed = expvar.NewInt("duplicates_suppressed")
+
+// DedupStore remembers the events the receiver has dispatched,
+// so that redeliveries of the same event are not dispatched again.
+type DedupStore interface {
+	// Seen reports whether key was marked and has not expired yet.
+	Seen(key string) (bool, error)
+	// Mark remembers key for the given time to live.
+	Mark(key string, ttl time.Duration) error
+}
+
+// dedupKey identifies an event by its source and id, which the spec
+// requires to be unique for distinct events.
+func dedupKey(ce *CloudEvent) string {
+	h := sha256.New()
+	h.Write([]byte(ce.Source))
+	h.Write([]byte{0})
+	h.Write([]byte(ce.EventID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dedupTargetKey identifies the dispatch of an event to one of its targets,
+// so the redelivery of an event that fanned out in part only goes to the
+// targets that failed.
+func dedupTargetKey(ce *CloudEvent, target string) string {
+	h := sha256.New()
+	h.Write([]byte(dedupKey(ce)))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var (
+	dedupOnce  sync.Once
+	dedupStore DedupStore
+)
+
+// getDedupStore returns the store configured through DEDUP_STORE,
+// or nil when deduplication is disabled:
+//
+//   - memory, an in-memory LRU of DEDUP_CAPACITY entries
+//   - bolt:<path>, a BoltDB file, which may be the one of OBJECT_STORE
+//   - an http(s) URL of a key-value service
+//
+// The store lives as long as the function container does.
+func getDedupStore() DedupStore {
+	dedupOnce.Do(func() {
+		store, err := newDedupStore(os.Getenv("DEDUP_STORE"))
+		if err != nil {
+			log.Println("deduplication is disabled: ", err.Error())
+			return
+		}
+		dedupStore = store
+	})
+	return dedupStore
+}
+
+func newDedupStore(config string) (DedupStore, error) {
+	if config == "" {
+		return nil, fmt.Errorf("DEDUP_STORE is not set")
+	}
+	kv, err := newKVStore(config, "dedup",
+		intWithDefault("DEDUP_CAPACITY", 10000), durationWithDefault("DEDUP_TIMEOUT", 5*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("DEDUP_STORE: %s", err.Error())
+	}
+	return NewDedupStore(kv), nil
+}
+
+// isDuplicate checks the event against the store. Store failures are logged
+// and the event is treated as new, dispatching twice beats losing an event.
+func isDuplicate(store DedupStore, ce *CloudEvent) bool {
+	if store == nil {
+		return false
+	}
+	seen, err := store.Seen(dedupKey(ce))
+	if err != nil {
+		log.Printf("unable to check event '%s' for duplicates: %s\n", ce.EventID, err.Error())
+		return false
+	}
+	if seen {
+		duplicatesSuppressed.Add(1)
+		log.Printf("event '%s' from '%s' is a duplicate, %d suppressed so far\n",
+			ce.EventID, ce.Source, duplicatesSuppressed.Value())
+	}
+	return seen
+}
+
+// isDispatchedTo checks whether the event already went to the target,
+// store failures are treated as the event being new to it.
+func isDispatchedTo(store DedupStore, ce *CloudEvent, target string) bool {
+	if store == nil {
+		return false
+	}
+	seen, err := store.Seen(dedupTargetKey(ce, target))
+	if err != nil {
+		log.Printf("unable to check event '%s' for dispatches to '%s': %s\n", ce.EventID, target, err.Error())
+		return false
+	}
+	return seen
+}
+
+func markDispatched(store DedupStore, ce *CloudEvent) {
+	mark(store, dedupKey(ce), ce)
+}
+
+func markDispatchedTo(store DedupStore, ce *CloudEvent, target string) {
+	mark(store, dedupTargetKey(ce, target), ce)
+}
+
+func mark(store DedupStore, key string, ce *CloudEvent) {
+	if store == nil {
+		return
+	}
+	err := store.Mark(key, durationWithDefault("DEDUP_TTL", 24*time.Hour))
+	if err != nil {
+		log.Printf("unable to remember event '%s': %s\n", ce.EventID, err.Error())
+	}
+}
+
+// kvDedupStore marks keys with a value of its own in a KVStore.
+type kvDedupStore struct {
+	kv KVStore
+}
+
+// NewDedupStore remembers event keys in kv.
+func NewDedupStore(kv KVStore) DedupStore {
+	return kvDedupStore{kv: kv}
+}
+
+func (s kvDedupStore) Seen(key string) (bool, error) {
+	v, err := s.kv.Get(key)
+	return v != nil, err
+}
+
+func (s kvDedupStore) Mark(key string, ttl time.Duration) error {
+	return s.kv.Put(key, []byte("1"), ttl)
+}
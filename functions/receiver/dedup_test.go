@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDedupStore(t *testing.T, store DedupStore) {
+	seen, err := store.Seen("a")
+	if err != nil || seen {
+		t.Fatalf("unknown key reported as seen: %v, %v", seen, err)
+	}
+	if err := store.Mark("a", time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+	seen, err = store.Seen("a")
+	if err != nil || !seen {
+		t.Fatalf("marked key not reported as seen: %v, %v", seen, err)
+	}
+	if err := store.Mark("b", -time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	seen, err = store.Seen("b")
+	if err != nil || seen {
+		t.Fatalf("expired key reported as seen: %v, %v", seen, err)
+	}
+}
+
+func TestDedupStore(t *testing.T) {
+	testDedupStore(t, NewDedupStore(NewMemoryKVStore(10)))
+}
+
+func TestMyHandlerSuppressesDuplicates(t *testing.T) {
+	getDedupStore()
+	dedupStore = NewDedupStore(NewMemoryKVStore(10))
+	defer func() { dedupStore = nil }()
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	before := duplicatesSuppressed.Value()
+	statuses := []string{}
+	for i := 0; i < 3; i++ {
+		in, err := os.Open("payloads/azure.payload.json")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp, err := myHandler(testContext(nil), in)
+		in.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		statuses = append(statuses, resp.(*HandlerResponse).Events[0].Status)
+	}
+
+	if len(d.bodies) != 1 {
+		t.Fatalf("Duplicates must not be dispatched, got %v dispatches", len(d.bodies))
+	}
+	expected := []string{statusDispatched, statusDuplicate, statusDuplicate}
+	if strings.Join(statuses, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Outcome mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, statuses)
+	}
+	if duplicatesSuppressed.Value()-before != 2 {
+		t.Fatalf("Expected 2 suppressed duplicates to be counted, got: %v",
+			duplicatesSuppressed.Value()-before)
+	}
+}
+
+func TestMyHandlerFanOutRedelivery(t *testing.T) {
+	getDedupStore()
+	dedupStore = NewDedupStore(NewMemoryKVStore(10))
+	defer func() { dedupStore = nil }()
+	os.Setenv("DISPATCH_MAX_RETRIES", "0")
+	defer os.Unsetenv("DISPATCH_MAX_RETRIES")
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	// the PNG processor fails the first delivery only
+	pngDeliveries := 0
+	png := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pngDeliveries++
+		if pngDeliveries == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer png.Close()
+
+	table, err := ParseRoutingTable([]byte(`
+routes:
+  - name: png
+    match: {extensions: [png]}
+    targets: [` + png.URL + `]
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	getRoutingTable()
+	routingTable = table
+	defer func() { routingTable = &RoutingTable{Default: []string{defaultTarget}} }()
+
+	var errs []error
+	for i := 0; i < 3; i++ {
+		in, err := os.Open("payloads/aws.notification.payload.json")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = myHandler(testContext(nil), in)
+		in.Close()
+		errs = append(errs, err)
+	}
+
+	if errs[0] == nil || errs[1] != nil || errs[2] != nil {
+		t.Fatalf("Expected only the first delivery to fail, got: %v", errs)
+	}
+	if len(d.bodies) != 1 {
+		t.Fatalf("Expected the image processor to receive the event once, got: %v", len(d.bodies))
+	}
+	if pngDeliveries != 2 {
+		t.Fatalf("Expected the PNG processor to receive the event twice, got: %v", pngDeliveries)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// DispatchError is returned when a dispatch target did not accept an event.
+type DispatchError struct {
+	Target     string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *DispatchError) Error() string {
+	return fmt.Sprintf("dispatch to '%s' failed with status %d: %s", e.Target, e.StatusCode, e.Body)
+}
+
+// temporary reports whether retrying the dispatch may help.
+func (e *DispatchError) temporary() bool {
+	return e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= http.StatusInternalServerError
+}
+
+type retryPolicy struct {
+	maxRetries int
+	base       time.Duration
+	max        time.Duration
+}
+
+func retryPolicyFromConfig() retryPolicy {
+	return retryPolicy{
+		maxRetries: intWithDefault("DISPATCH_MAX_RETRIES", 3),
+		base:       durationWithDefault("DISPATCH_BACKOFF_BASE", 500*time.Millisecond),
+		max:        durationWithDefault("DISPATCH_BACKOFF_MAX", 30*time.Second),
+	}
+}
+
+// backoff returns how long to wait before the n-th retry: a random duration
+// up to an exponentially growing bound, capped by the policy maximum.
+func (p retryPolicy) backoff(n int) time.Duration {
+	bound := p.base << uint(n-1)
+	if bound > p.max || bound <= 0 {
+		bound = p.max
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound)) + 1)
+}
+
+// parseRetryAfter understands both forms of the Retry-After header,
+// delay seconds and an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// dispatch sends the media of ce to a target. URLs are signed last, so signed
+// URLs are only ever dispatched: the dead letter keeps the event with the
+// unsigned ones, which neither stores credentials nor replays signatures
+// that have expired by the time the event is redriven.
+func dispatch(ctx context.Context, ce *CloudEvent, media []Media, target string) error {
+	signed, err := signMedia(media)
+	if err != nil {
+		return err
+	}
+	outCE := NewMediaReceivedEvent(ctx, ce, signed)
+	unsigned := *outCE
+	unsigned.Data = newMediaProcessor(ce, media)
+	return dispatchEvent(ctx, ce, outCE, &unsigned, target)
+}
+
+// dispatchEvent sends an event derived from ce to a target. An event that
+// cannot be delivered, even after retrying, is handed over to the dead-letter
+// sink as deadCE, which is the event without the credentials it may carry.
+func dispatchEvent(ctx context.Context, ce, outCE, deadCE *CloudEvent, target string) error {
+	target = resolveTarget(ctx, target)
+	log.Println("dispatch target: ", target)
+
+	body, hs, err := EncodeCloudEvent(outCE, withDefault("DISPATCH_MODE", binaryMode))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("dispatching event '%s' related to '%s'\n", outCE.EventID, ce.EventID)
+	attempts, err := deliverWithRetry(ctx, target, body, hs, retryPolicyFromConfig())
+	if err == nil {
+		return nil
+	}
+
+	dl := &DeadLetter{
+		EventID:   outCE.EventID,
+		RelatedID: ce.EventID,
+		Target:    target,
+		Header:    hs,
+		Body:      body,
+		Reason:    err.Error(),
+		Attempts:  attempts,
+		Time:      time.Now().UTC(),
+	}
+	dlErr := deadLetterUnsigned(dl, outCE, deadCE)
+	if dlErr == nil {
+		dlErr = sendToDeadLetter(ctx, dl)
+	}
+	if dlErr != nil {
+		log.Printf("unable to dead-letter event '%s': %s\n", outCE.EventID, dlErr.Error())
+	}
+	return err
+}
+
+// deadLetterUnsigned has the dead letter keep deadCE rather than the event
+// delivery was attempted with, and flags it if the two differ.
+func deadLetterUnsigned(dl *DeadLetter, outCE, deadCE *CloudEvent) error {
+	if deadCE == outCE {
+		return nil
+	}
+	body, hs, err := EncodeCloudEvent(deadCE, withDefault("DISPATCH_MODE", binaryMode))
+	if err != nil {
+		return err
+	}
+	dl.Unsigned = !bytes.Equal(body, dl.Body)
+	dl.Body, dl.Header = body, hs
+	return nil
+}
+
+// deliverWithRetry retries failed deliveries with a jittered exponential
+// backoff, as long as the failure looks temporary and the function deadline
+// leaves time for another attempt. It returns the number of attempts made.
+func deliverWithRetry(ctx context.Context, target string, body []byte, hs http.Header, policy retryPolicy) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := deliver(ctx, target, body, hs)
+		if err == nil {
+			return attempt, nil
+		}
+		if attempt > policy.maxRetries {
+			return attempt, err
+		}
+
+		wait := policy.backoff(attempt)
+		if de, ok := err.(*DispatchError); ok {
+			if !de.temporary() {
+				return attempt, err
+			}
+			if de.RetryAfter > wait {
+				wait = de.RetryAfter
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			log.Printf("no time left to retry delivery to '%s' before the deadline\n", target)
+			return attempt, err
+		}
+
+		log.Printf("attempt %d to deliver to '%s' failed, retrying in %s: %s\n",
+			attempt, target, wait, err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return attempt, err
+		}
+	}
+}
+
+func deliver(ctx context.Context, target string, body []byte, hs http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range hs {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode > 202 {
+		return &DispatchError{
+			Target:     target,
+			StatusCode: resp.StatusCode,
+			Body:       string(b),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+func init() {
+	RegisterNativeDecoder(DecodeEventGridEvents)
+	RegisterHandshake("Microsoft.EventGrid.SubscriptionValidationEvent", ValidateEventGridSubscription)
+}
+
+// EventGridEvent is an event in the Event Grid schema.
+type EventGridEvent struct {
+	ID              string          `json:"id"`
+	Topic           string          `json:"topic"`
+	Subject         string          `json:"subject"`
+	EventType       string          `json:"eventType"`
+	EventTime       time.Time       `json:"eventTime"`
+	Data            json.RawMessage `json:"data"`
+	DataVersion     string          `json:"dataVersion"`
+	MetadataVersion string          `json:"metadataVersion"`
+}
+
+type EventGridValidationData struct {
+	ValidationCode string `json:"validationCode"`
+	ValidationURL  string `json:"validationUrl"`
+}
+
+type EventGridValidationResponse struct {
+	ValidationResponse string `json:"validationResponse"`
+}
+
+// DecodeEventGridEvents recognizes the arrays of events Event Grid delivers
+// in its own schema and turns each of them into an event.
+func DecodeEventGridEvents(body []byte) ([]*CloudEvent, bool, error) {
+	var batch []EventGridEvent
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+		return nil, false, nil
+	}
+	if batch[0].EventType == "" || (batch[0].MetadataVersion == "" && batch[0].Topic == "") {
+		return nil, false, nil
+	}
+
+	events := make([]*CloudEvent, 0, len(batch))
+	for _, e := range batch {
+		var data interface{}
+		if len(e.Data) > 0 {
+			if err := json.Unmarshal(e.Data, &data); err != nil {
+				return nil, true, fmt.Errorf("Event Grid event '%s' has invalid data: %s", e.ID, err.Error())
+			}
+		}
+		events = append(events, &CloudEvent{
+			CloudEventsVersion: "1.0",
+			EventID:            e.ID,
+			Source:             e.Topic,
+			EventType:          e.EventType,
+			EventTypeVersion:   e.DataVersion,
+			EventTime:          e.EventTime,
+			ContentType:        "application/json",
+			Subject:            e.Subject,
+			Extensions:         map[string]interface{}{},
+			Data:               data,
+		})
+	}
+	return events, true, nil
+}
+
+// ValidateEventGridSubscription completes the handshake Event Grid starts
+// before delivering events to a new subscription.
+func ValidateEventGridSubscription(ce *CloudEvent) (interface{}, error) {
+	b, err := json.Marshal(ce.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var d EventGridValidationData
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.ValidationCode == "" {
+		return nil, fmt.Errorf("subscription validation event '%s' has no validation code", ce.EventID)
+	}
+
+	return &EventGridValidationResponse{ValidationResponse: d.ValidationCode}, nil
+}
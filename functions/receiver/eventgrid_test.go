@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEventGridSubscriptionValidation(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	in, err := os.Open("payloads/eventgrid.validation.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	resp, err := myHandler(testContext(nil), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := &EventGridValidationResponse{ValidationResponse: "512d38b6-c7b8-40c8-89fe-f46f9e9622b6"}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Fatalf("Validation response mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, resp)
+	}
+	if len(d.bodies) != 0 {
+		t.Fatalf("Validation events must not be dispatched, got: %v", d.bodies)
+	}
+}
+
+func TestEventGridBatch(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	in, err := os.Open("payloads/eventgrid.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	_, err = myHandler(testContext(nil), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []MediaProcessor{
+		{
+			EventID:   "96fb5f0b-001e-0108-6dfe-da6e2806f124",
+			EventType: "Microsoft.Storage.BlobCreated",
+			MediaURL:  []string{"https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg"},
+		},
+		{
+			EventID:   "96fb5f0b-001e-0108-6dfe-da6e2806f125",
+			EventType: "Microsoft.Storage.BlobCreated",
+			MediaURL:  []string{"https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0005.jpg"},
+		},
+	}
+	if !reflect.DeepEqual(d.bodies, expected) {
+		t.Fatalf("Dispatch mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, d.bodies)
+	}
+}
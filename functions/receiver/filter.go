@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// MediaFilter keeps media the processors cannot handle, such as huge videos
+// or text files, from being dispatched. Types are patterns where '*' matches
+// any sequence of characters, extensions are compared case-insensitively.
+// Deny rules win over allow rules, empty rules allow anything.
+type MediaFilter struct {
+	AllowTypes      []string
+	DenyTypes       []string
+	AllowExtensions []string
+	DenyExtensions  []string
+	MinSize         int64
+	MaxSize         int64
+}
+
+// SkippedMedia is media a filter kept from being dispatched. It is
+// referred to by its object, see Media.reference, as URLs may be signed.
+type SkippedMedia struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func mediaFilterFromConfig() MediaFilter {
+	return MediaFilter{
+		AllowTypes:      listFromConfig("MEDIA_ALLOW_TYPES"),
+		DenyTypes:       listFromConfig("MEDIA_DENY_TYPES"),
+		AllowExtensions: listFromConfig("MEDIA_ALLOW_EXTENSIONS"),
+		DenyExtensions:  listFromConfig("MEDIA_DENY_EXTENSIONS"),
+		MinSize:         sizeWithDefault("MEDIA_MIN_SIZE", 0),
+		MaxSize:         sizeWithDefault("MEDIA_MAX_SIZE", 0),
+	}
+}
+
+// mediaType is the content type the provider reported for the media,
+// without parameters, or else the one its extension suggests.
+func mediaType(m *Media) string {
+	if m.ContentType != "" {
+		if t, _, err := mime.ParseMediaType(m.ContentType); err == nil {
+			return t
+		}
+		return strings.ToLower(m.ContentType)
+	}
+	if ext := mediaExtension(m); ext != "" {
+		if t, _, err := mime.ParseMediaType(mime.TypeByExtension("." + ext)); err == nil {
+			return t
+		}
+	}
+	return ""
+}
+
+func matchesAnyType(patterns []string, t string) bool {
+	for _, p := range patterns {
+		if globMatch(strings.ToLower(p), t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyExtension(extensions []string, ext string) bool {
+	for _, e := range extensions {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject returns why the media must not be dispatched, or an empty string.
+// Unknown sizes pass the size rules, an unknown type or extension only
+// fails an allow list.
+func (f MediaFilter) reject(m *Media) string {
+	t := mediaType(m)
+	if t != "" && matchesAnyType(f.DenyTypes, t) {
+		return fmt.Sprintf("content type '%s' is denied", t)
+	}
+	if len(f.AllowTypes) > 0 && !matchesAnyType(f.AllowTypes, t) {
+		if t == "" {
+			return "content type is unknown"
+		}
+		return fmt.Sprintf("content type '%s' is not allowed", t)
+	}
+
+	ext := mediaExtension(m)
+	if ext != "" && matchesAnyExtension(f.DenyExtensions, ext) {
+		return fmt.Sprintf("extension '%s' is denied", ext)
+	}
+	if len(f.AllowExtensions) > 0 && !matchesAnyExtension(f.AllowExtensions, ext) {
+		if ext == "" {
+			return "media has no extension"
+		}
+		return fmt.Sprintf("extension '%s' is not allowed", ext)
+	}
+
+	if m.Size > 0 && f.MinSize > 0 && m.Size < f.MinSize {
+		return fmt.Sprintf("size %d is below the minimum of %d bytes", m.Size, f.MinSize)
+	}
+	if m.Size > 0 && f.MaxSize > 0 && m.Size > f.MaxSize {
+		return fmt.Sprintf("size %d exceeds the maximum of %d bytes", m.Size, f.MaxSize)
+	}
+	return ""
+}
+
+// Apply splits media into what may be dispatched and what is skipped.
+func (f MediaFilter) Apply(media []Media) (kept []Media, skipped []SkippedMedia) {
+	for _, m := range media {
+		if reason := f.reject(&m); reason != "" {
+			skipped = append(skipped, SkippedMedia{URL: m.reference(), Reason: reason})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, skipped
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMediaMetadata(t *testing.T) {
+	testSuites := []struct {
+		payload     string
+		contentType string
+		size        int64
+	}{
+		{"payloads/aws.payload.json", "", 444684},
+		{"payloads/azure.payload.json", "image/jpeg", 2779325},
+		{"payloads/gcs.payload.json", "image/jpeg", 444684},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.payload, func(t *testing.T) {
+			media, err := GetMedia(loadCloudEvent(t, ts.payload))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if media[0].ContentType != ts.contentType || media[0].Size != ts.size {
+				t.Fatalf("Media metadata mismatch!"+
+					"\n\tExpected: %v, %v"+
+					"\n\tActual: %v, %v", ts.contentType, ts.size, media[0].ContentType, media[0].Size)
+			}
+		})
+	}
+}
+
+func TestMediaFilter(t *testing.T) {
+	filter := MediaFilter{
+		AllowTypes:     []string{"image/*"},
+		DenyTypes:      []string{"image/svg+xml"},
+		DenyExtensions: []string{".gif"},
+		MinSize:        1024,
+		MaxSize:        50 << 20,
+	}
+
+	testSuites := []struct {
+		name   string
+		media  Media
+		reject bool
+	}{
+		{"image", Media{URL: "https://example.com/a.jpg", Size: 444684}, false},
+		{"reported-type", Media{URL: "https://example.com/a", ContentType: "image/png; charset=binary"}, false},
+		{"unknown-size", Media{URL: "https://example.com/a.png"}, false},
+		{"text", Media{URL: "https://example.com/a.txt"}, true},
+		{"unknown-type", Media{URL: "https://example.com/a"}, true},
+		{"denied-type", Media{URL: "https://example.com/a.svg"}, true},
+		{"denied-extension", Media{URL: "https://example.com/a.GIF"}, true},
+		{"too-small", Media{URL: "https://example.com/a.jpg", Size: 100}, true},
+		{"too-large", Media{URL: "https://example.com/a.jpg", ContentType: "image/jpeg", Size: 2 << 30}, true},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			reason := filter.reject(&ts.media)
+			if (reason != "") != ts.reject {
+				t.Fatalf("Unexpected filter decision for %v: '%s'", ts.media, reason)
+			}
+		})
+	}
+}
+
+func TestSizeWithDefault(t *testing.T) {
+	defer os.Unsetenv("MEDIA_MAX_SIZE")
+	for v, expected := range map[string]int64{
+		"":        -1,
+		"1048576": 1 << 20,
+		"512KB":   512 << 10,
+		"2 GB":    2 << 30,
+		"10mb":    10 << 20,
+		"lots":    -1,
+	} {
+		os.Setenv("MEDIA_MAX_SIZE", v)
+		if size := sizeWithDefault("MEDIA_MAX_SIZE", -1); size != expected {
+			t.Fatalf("Size of '%s' mismatch!"+
+				"\n\tExpected: %v"+
+				"\n\tActual: %v", v, expected, size)
+		}
+	}
+}
+
+func TestMyHandlerFiltered(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	// the png of the notification is 1MB
+	os.Setenv("MEDIA_MAX_SIZE", "512KB")
+	defer os.Unsetenv("MEDIA_MAX_SIZE")
+
+	in, err := os.Open("payloads/aws.notification.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	resp, err := myHandler(testContext(nil), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{"https://s3.us-west-2.amazonaws.com/cloudevents/dan_kohn.jpg"}
+	if len(d.bodies) != 1 || !reflect.DeepEqual(d.bodies[0].MediaURL, expected) {
+		t.Fatalf("Dispatch mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, d.bodies)
+	}
+	// the removed object of the notification is skipped, as there is no cleanup target
+	outcome := resp.(*HandlerResponse).Events[0]
+	if outcome.Status != statusDispatched || len(outcome.Skipped) != 2 {
+		t.Fatalf("Unexpected outcome: %+v", outcome)
+	}
+
+	t.Run("all-filtered", func(t *testing.T) {
+		os.Setenv("MEDIA_MAX_SIZE", "1KB")
+		in.Seek(0, 0)
+		resp, err := myHandler(testContext(nil), in)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(d.bodies) != 1 {
+			t.Fatalf("Expected no further dispatch, got: %v", len(d.bodies)-1)
+		}
+		outcome := resp.(*HandlerResponse).Events[0]
+		if outcome.Status != statusSkipped || len(outcome.Skipped) != 3 {
+			t.Fatalf("Unexpected outcome: %+v", outcome)
+		}
+	})
+}
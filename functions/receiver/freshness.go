@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// EventTimeError is returned for an event whose time is outside the
+// freshness window, either stale or too far in the future.
+type EventTimeError struct {
+	EventID string
+	Time    time.Time
+	Stale   bool
+}
+
+func (e *EventTimeError) Error() string {
+	if e.Stale {
+		return fmt.Sprintf("event '%s' of %s is stale", e.EventID, e.Time.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("event '%s' of %s is in the future", e.EventID, e.Time.Format(time.RFC3339))
+}
+
+// statusCode tells stale events (410 Gone) apart from those
+// of the future (425 Too Early).
+func (e *EventTimeError) statusCode() int {
+	if e.Stale {
+		return http.StatusGone
+	}
+	return http.StatusTooEarly
+}
+
+type freshnessPolicy struct {
+	maxAge      time.Duration
+	clockSkew   time.Duration
+	allowReplay bool
+}
+
+func freshnessPolicyFromConfig() freshnessPolicy {
+	return freshnessPolicy{
+		maxAge:      durationWithDefault("EVENT_MAX_AGE", 24*time.Hour),
+		clockSkew:   durationWithDefault("EVENT_CLOCK_SKEW", 5*time.Minute),
+		allowReplay: withDefault("EVENT_ALLOW_REPLAY", "false") == "true",
+	}
+}
+
+// check rejects events older than the maximum age or further in the future
+// than the clock skew, which is allowed for on both ends of the window.
+// Events without a time, and every event when replays are allowed
+// or the maximum age is 0, pass.
+func (p freshnessPolicy) check(ce *CloudEvent, now time.Time) error {
+	if p.allowReplay || p.maxAge <= 0 || ce.EventTime.IsZero() {
+		return nil
+	}
+	age := now.Sub(ce.EventTime)
+	if age > p.maxAge+p.clockSkew {
+		return &EventTimeError{EventID: ce.EventID, Time: ce.EventTime, Stale: true}
+	}
+	if age < -p.clockSkew {
+		return &EventTimeError{EventID: ce.EventID, Time: ce.EventTime}
+	}
+	return nil
+}
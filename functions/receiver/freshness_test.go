@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFreshnessPolicy(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	policy := freshnessPolicy{maxAge: time.Hour, clockSkew: time.Minute}
+
+	testSuites := []struct {
+		name   string
+		policy freshnessPolicy
+		time   time.Time
+		status int
+	}{
+		{"fresh", policy, now.Add(-30 * time.Minute), 0},
+		{"within-skew", policy, now.Add(-time.Hour - 30*time.Second), 0},
+		{"stale", policy, now.Add(-2 * time.Hour), http.StatusGone},
+		{"skewed", policy, now.Add(30 * time.Second), 0},
+		{"future", policy, now.Add(10 * time.Minute), http.StatusTooEarly},
+		{"no-time", policy, time.Time{}, 0},
+		{"replay", freshnessPolicy{maxAge: time.Hour, allowReplay: true}, now.Add(-24 * time.Hour), 0},
+		{"disabled", freshnessPolicy{}, now.Add(-24 * time.Hour), 0},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			err := ts.policy.check(&CloudEvent{EventID: "1", EventTime: ts.time}, now)
+			status := 0
+			if err != nil {
+				status = statusCode(err)
+			}
+			if status != ts.status {
+				t.Fatalf("Status mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v (%v)", ts.status, status, err)
+			}
+		})
+	}
+}
+
+func TestMyHandlerRejectsStaleEvents(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+	os.Unsetenv("EVENT_ALLOW_REPLAY")
+
+	in, err := os.Open("payloads/aws.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	_, err = myHandler(testContext(nil), in)
+	var terr *EventTimeError
+	if !errors.As(err, &terr) || !terr.Stale {
+		t.Fatalf("Expected a stale *EventTimeError, got: %v", err)
+	}
+	if len(d.bodies) != 0 {
+		t.Fatalf("Stale events must not be dispatched, got: %v", d.bodies)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,28 +11,62 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fnproject/fdk-go"
 )
 
 func main() {
-	fdk.Handle(fdk.HandlerFunc(withError))
+	opts, err := parseServerOptions(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	if !opts.Enabled {
+		fdk.Handle(fdk.HandlerFunc(withError))
+		return
+	}
+	if err := serve(opts); err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
 func withError(ctx context.Context, in io.Reader, out io.Writer) {
-	err := myHandler(ctx, in)
+	resp, err := myHandler(ctx, in)
 	if err != nil {
-		log.Println("unable to decode incoming stream, got error: ", err.Error())
-		fdk.WriteStatus(out, http.StatusInternalServerError)
-		out.Write([]byte(err.Error()))
+		log.Println("unable to handle incoming stream, got error: ", err.Error())
+		p := NewProblem(err)
+		if p.Status == http.StatusNoContent {
+			fdk.WriteStatus(out, p.Status)
+			return
+		}
+		for k, v := range p.Header() {
+			fdk.SetHeader(out, k, v[0])
+		}
+		fdk.WriteStatus(out, p.Status)
+		json.NewEncoder(out).Encode(p)
 		return
 	}
+	if resp != nil {
+		fdk.SetHeader(out, "Content-Type", "application/json")
+		json.NewEncoder(out).Encode(resp)
+	}
 }
 
+// MediaProcessor is the data of the events the receiver dispatches.
+// Overwrites lists the media that replaces an earlier version of its object,
+// whatever was derived from the earlier version is stale. OutOfOrder lists
+// the media older than a version of its object dispatched before, its results
+// must not replace those of the newer version. Probes holds the results
+// of the pre-flight probe.
 type MediaProcessor struct {
-	EventID   string   `json:"event_id"`
-	EventType string   `json:"event_type"`
-	MediaURL  []string `json:"media"`
+	EventID    string       `json:"event_id"`
+	EventType  string       `json:"event_type"`
+	MediaURL   []string     `json:"media"`
+	Overwrites []string     `json:"overwrites,omitempty"`
+	OutOfOrder []string     `json:"out_of_order,omitempty"`
+	Probes     []MediaProbe `json:"probes,omitempty"`
 }
 
 func withDefault(key, defaultValue string) string {
@@ -44,63 +77,277 @@ func withDefault(key, defaultValue string) string {
 	return envValue
 }
 
-func myHandler(ctx context.Context, in io.Reader) error {
-	var ce CloudEvent
-	err := json.NewDecoder(in).Decode(&ce)
+func intWithDefault(key string, defaultValue int) int {
+	v, err := strconv.Atoi(withDefault(key, strconv.Itoa(defaultValue)))
 	if err != nil {
-		return err
+		log.Printf("invalid %s, falling back to %d: %s\n", key, defaultValue, err.Error())
+		return defaultValue
 	}
+	return v
+}
 
-	imgURL, err := GetImageURL(&ce)
+func durationWithDefault(key string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(withDefault(key, defaultValue.String()))
 	if err != nil {
-		return err
+		log.Printf("invalid %s, falling back to %s: %s\n", key, defaultValue, err.Error())
+		return defaultValue
 	}
+	return d
+}
 
+// listFromConfig splits a comma separated config into its trimmed, non-empty items.
+func listFromConfig(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sizeWithDefault reads a number of bytes, optionally with a
+// KB, MB or GB suffix (powers of 1024).
+func sizeWithDefault(key string, defaultValue int64) int64 {
+	v := strings.ToUpper(strings.TrimSpace(os.Getenv(key)))
+	if v == "" {
+		return defaultValue
+	}
+	unit := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB"} {
+		if strings.HasSuffix(v, suffix) {
+			unit = 1 << (10 * uint(i+1))
+			v = strings.TrimSpace(strings.TrimSuffix(v, suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(v, "B"), 10, 64)
+	if err != nil {
+		log.Printf("invalid %s, falling back to %d: %s\n", key, defaultValue, err.Error())
+		return defaultValue
+	}
+	return n * unit
+}
+
+// fnAPIURL is the base URL of the Fn API the receiver was invoked through,
+// unless FN_API_URL says otherwise.
+func fnAPIURL(ctx context.Context) string {
+	var apiURL string
+	if u, err := url.Parse(fdk.Context(ctx).RequestURL); err == nil && u.Host != "" {
+		apiURL = u.Scheme + "://" + u.Host
+	}
+	return withDefault("FN_API_URL", apiURL)
+}
+
+// fnTriggerURL is the URL of a function of the receiver's app.
+func fnTriggerURL(ctx context.Context, path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return fmt.Sprintf("%s/t/%s%s", fnAPIURL(ctx), os.Getenv("FN_APP_NAME"), path)
+}
+
+const (
+	statusDispatched  = "dispatched"
+	statusDuplicate   = "duplicate"
+	statusUnsupported = "unsupported"
+	statusSkipped     = "skipped"
+	statusRejected    = "rejected"
+)
+
+// EventOutcome tells the caller what became of an event.
+type EventOutcome struct {
+	EventID  string         `json:"id"`
+	Status   string         `json:"status"`
+	Reason   string         `json:"reason,omitempty"`
+	Targets  []string       `json:"targets,omitempty"`
+	Skipped  []SkippedMedia `json:"skipped,omitempty"`
+	Rejected []SkippedMedia `json:"rejected,omitempty"`
+}
+
+type HandlerResponse struct {
+	Events []EventOutcome `json:"events"`
+}
+
+// myHandler dispatches the media of every incoming event, once the caller is
+// authenticated. The returned value, if any, is sent back to the caller as JSON.
+func myHandler(ctx context.Context, in io.Reader) (interface{}, error) {
+	body, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, &MalformedEventError{Err: err}
+	}
 	fctx := fdk.Context(ctx)
-	u, _ := url.Parse(fctx.RequestURL)
-	fnAPIURL := fctx.RequestURL[:len(fctx.RequestURL)-len(u.EscapedPath())]
-	fnAPIURL = withDefault("FN_API_URL", fnAPIURL)
-
-	// if os.Getenv("IS_DOCKER4MAC_LOCAL") == "true" {
-	// 	fnAPIURL = "http://docker.for.mac.localhost:8080"
-	// }
-
-	log.Println("Fn API URL: ", fnAPIURL)
-
-	req, _ := http.NewRequest(
-		http.MethodPost,
-		fmt.Sprintf("%s/t/%s%s", fnAPIURL, os.Getenv("FN_APP_NAME"), "/image-processor"),
-		nil,
-	)
-
-	media := MediaProcessor{
-		MediaURL: []string{
-			*imgURL,
-		},
-		EventType: ce.EventType,
-		EventID:   ce.EventID,
-	}
-	var buf bytes.Buffer
-	err = json.NewEncoder(&buf).Encode(media)
+	err = authenticate(authenticatorsFromConfig(), &InboundRequest{
+		Header: fctx.Header, URL: fctx.RequestURL, Body: body})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req.Body = ioutil.NopCloser(&buf)
-	resp, err := http.DefaultClient.Do(req)
+	events, err := DecodeCloudEvents(ctx, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, &MalformedEventError{Err: err}
+	}
+
+	for _, ce := range events {
+		if handshake, ok := LookupHandshake(ce); ok {
+			log.Printf("answering handshake event '%s' of type '%s'\n", ce.EventID, ce.EventType)
+			resp, err := handshake(ce)
+			if err != nil {
+				return nil, &EventError{EventID: ce.EventID, Err: err}
+			}
+			return resp, nil
+		}
 	}
-	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
+	routes, err := getRoutingTable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if resp.StatusCode > 202 {
-		return errors.New(string(b))
+	store := getDedupStore()
+	filter := mediaFilterFromConfig()
+	policy := urlPolicyFromConfig()
+	freshness := freshnessPolicyFromConfig()
+	tracker := objectTrackerFromConfig()
+	prober := proberFromConfig()
+	resp := &HandlerResponse{}
+	for _, ce := range events {
+		if err := freshness.check(ce, time.Now()); err != nil {
+			if len(events) == 1 {
+				return nil, &EventError{EventID: ce.EventID, Err: err}
+			}
+			log.Printf("skipping event '%s': %s\n", ce.EventID, err.Error())
+			resp.Events = append(resp.Events, EventOutcome{
+				EventID: ce.EventID, Status: statusRejected, Reason: err.Error()})
+			continue
+		}
+
+		if isDuplicate(store, ce) {
+			resp.Events = append(resp.Events, EventOutcome{EventID: ce.EventID, Status: statusDuplicate})
+			continue
+		}
+
+		if err := validateData(ctx, ce); err != nil {
+			if _, ok := err.(*SchemaValidationError); ok && len(events) > 1 {
+				log.Printf("skipping event '%s': %s\n", ce.EventID, err.Error())
+				resp.Events = append(resp.Events, EventOutcome{
+					EventID: ce.EventID, Status: statusRejected, Reason: err.Error()})
+				continue
+			}
+			return nil, &EventError{EventID: ce.EventID, Err: err}
+		}
+
+		media, err := GetMedia(ce)
+		if err != nil {
+			if _, ok := err.(*UnsupportedEventError); ok && len(events) > 1 {
+				// a single event of a batch must not fail the others
+				log.Printf("skipping event '%s': %s\n", ce.EventID, err.Error())
+				resp.Events = append(resp.Events, EventOutcome{
+					EventID: ce.EventID, Status: statusUnsupported, Reason: err.Error()})
+				continue
+			}
+			if _, ok := err.(*MappingError); ok && len(events) > 1 {
+				log.Printf("skipping event '%s': %s\n", ce.EventID, err.Error())
+				resp.Events = append(resp.Events, EventOutcome{
+					EventID: ce.EventID, Status: statusRejected, Reason: err.Error()})
+				continue
+			}
+			return nil, &EventError{EventID: ce.EventID, Err: err}
+		}
+
+		media, stale := tracker.Apply(ce, media)
+		media, deleted := splitDeleted(media)
+		outcome := EventOutcome{EventID: ce.EventID, Status: statusDispatched, Skipped: stale}
+		if len(deleted) > 0 {
+			target, err := cleanup(ctx, ce, deleted)
+			if err != nil {
+				return nil, &EventError{EventID: ce.EventID, Err: err}
+			}
+			if target != "" {
+				tracker.Remember(ce, deleted)
+				outcome.Targets = append(outcome.Targets, target)
+			} else {
+				for _, m := range deleted {
+					outcome.Skipped = append(outcome.Skipped, SkippedMedia{URL: m.reference(), Reason: "no cleanup target"})
+				}
+			}
+		}
+		if len(media) == 0 {
+			if len(outcome.Targets) == 0 {
+				log.Printf("skipping event '%s': none of its media is left to dispatch\n", ce.EventID)
+				outcome.Status = statusSkipped
+				outcome.Reason = "no media left to dispatch"
+			} else {
+				markDispatched(store, ce)
+			}
+			resp.Events = append(resp.Events, outcome)
+			continue
+		}
+
+		media, violations := policy.Apply(ctx, ce, media)
+		for _, v := range violations {
+			log.Printf("rejecting media of event '%s': %s\n", ce.EventID, v.Error())
+			outcome.Rejected = append(outcome.Rejected, SkippedMedia{URL: v.URL, Reason: v.Reason})
+		}
+		if len(media) == 0 && len(violations) > 0 {
+			if len(events) == 1 {
+				return nil, &EventError{EventID: ce.EventID, Err: violations[0]}
+			}
+			outcome.Status = statusRejected
+			outcome.Reason = "all media URLs are rejected"
+			resp.Events = append(resp.Events, outcome)
+			continue
+		}
+
+		media, failures := prober.Apply(ctx, ce, media)
+		for _, f := range failures {
+			outcome.Rejected = append(outcome.Rejected, SkippedMedia{URL: f.URL, Reason: f.Reason})
+		}
+		if len(media) == 0 && len(failures) > 0 {
+			if len(events) == 1 {
+				return nil, &EventError{EventID: ce.EventID, Err: failures[0]}
+			}
+			outcome.Status = statusRejected
+			outcome.Reason = "no media is reachable"
+			resp.Events = append(resp.Events, outcome)
+			continue
+		}
+
+		media, skipped := filter.Apply(media)
+		outcome.Skipped = append(outcome.Skipped, skipped...)
+		if len(media) == 0 {
+			log.Printf("skipping event '%s': all of its media is filtered\n", ce.EventID)
+			outcome.Status = statusSkipped
+			outcome.Reason = "all media is filtered"
+			resp.Events = append(resp.Events, outcome)
+			continue
+		}
+
+		// every target is remembered once it accepted the event, a failing
+		// target does not hold up the others and a redelivery only goes to it
+		var dispatchErr error
+		for _, d := range routes.Plan(ce, media) {
+			if isDispatchedTo(store, ce, d.Target) {
+				log.Printf("event '%s' was dispatched to '%s' before\n", ce.EventID, d.Target)
+				outcome.Targets = append(outcome.Targets, d.Target)
+				continue
+			}
+			if err := dispatch(ctx, ce, d.Media, d.Target); err != nil {
+				if dispatchErr == nil {
+					dispatchErr = err
+				}
+				continue
+			}
+			markDispatchedTo(store, ce, d.Target)
+			outcome.Targets = append(outcome.Targets, d.Target)
+		}
+		if dispatchErr != nil {
+			return nil, &EventError{EventID: ce.EventID, Err: dispatchErr}
+		}
+		tracker.Remember(ce, media)
+		markDispatched(store, ce)
+		resp.Events = append(resp.Events, outcome)
 	}
 
-	return nil
+	return resp, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/fnproject/fdk-go"
+)
+
+// dispatchRecorder stands in for the Fn API, recording what the receiver
+// dispatches to the image-processor. Meanwhile media hosts resolve
+// to a public documentation address, so tests do not depend on DNS.
+type dispatchRecorder struct {
+	*httptest.Server
+	requests []*http.Request
+	events   []*CloudEvent
+	bodies   []MediaProcessor
+}
+
+func publicLookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: net.ParseIP("203.0.113.10")}}, nil
+}
+
+func newDispatchRecorder(t *testing.T) *dispatchRecorder {
+	d := &dispatchRecorder{}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ce := new(CloudEvent)
+		var err error
+		if r.Header.Get("Content-Type") == structuredContentType {
+			err = json.Unmarshal(body, ce)
+		} else {
+			ce, err = NewBinaryCloudEvent(r.Header, body)
+		}
+		if err != nil {
+			t.Error(err.Error())
+		}
+
+		var mp MediaProcessor
+		b, _ := json.Marshal(ce.Data)
+		if err := json.Unmarshal(b, &mp); err != nil {
+			t.Error(err.Error())
+		}
+		d.requests = append(d.requests, r)
+		d.events = append(d.events, ce)
+		d.bodies = append(d.bodies, mp)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	os.Setenv("FN_API_URL", d.URL)
+	os.Setenv("FN_APP_NAME", "cloudevents")
+	lookupIPAddr = publicLookupIPAddr
+	// the fixtures are years old
+	os.Setenv("EVENT_ALLOW_REPLAY", "true")
+	return d
+}
+
+func (d *dispatchRecorder) Close() {
+	d.Server.Close()
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	os.Unsetenv("FN_API_URL")
+	os.Unsetenv("FN_APP_NAME")
+	os.Unsetenv("EVENT_ALLOW_REPLAY")
+}
+
+func testContext(hs http.Header) context.Context {
+	if hs == nil {
+		hs = http.Header{}
+	}
+	return fdk.WithContext(context.Background(), &fdk.Ctx{
+		Header:     hs,
+		RequestURL: "http://localhost:8080/t/cloudevents/receiver",
+		Method:     http.MethodPost,
+	})
+}
+
+func TestMyHandlerS3Notification(t *testing.T) {
+	expected := []string{
+		"https://s3.us-west-2.amazonaws.com/cloudevents/dan_kohn.jpg",
+		"https://s3.us-west-2.amazonaws.com/cloudevents/team/fn%20project.png",
+	}
+
+	for _, payload := range []string{
+		"payloads/aws.notification.payload.json",
+		"payloads/aws.records.payload.json",
+	} {
+		t.Run(payload, func(t *testing.T) {
+			d := newDispatchRecorder(t)
+			defer d.Close()
+
+			in, err := os.Open(payload)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer in.Close()
+
+			_, err = myHandler(testContext(nil), in)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(d.bodies) != 1 {
+				t.Fatalf("Expected exactly one dispatch, got: %v", len(d.bodies))
+			}
+			if d.requests[0].URL.Path != "/t/cloudevents/image-processor" {
+				t.Fatalf("Unexpected dispatch path: %v", d.requests[0].URL.Path)
+			}
+			if !reflect.DeepEqual(d.bodies[0].MediaURL, expected) {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", expected, d.bodies[0].MediaURL)
+			}
+			if d.bodies[0].EventID != "C3D13FE58DE4C810" {
+				t.Fatalf("Unexpected event ID: %v", d.bodies[0].EventID)
+			}
+		})
+	}
+}
+
+func TestMyHandlerDispatchModes(t *testing.T) {
+	defer os.Unsetenv("DISPATCH_MODE")
+
+	for _, mode := range []string{binaryMode, structuredMode} {
+		t.Run(mode, func(t *testing.T) {
+			os.Setenv("DISPATCH_MODE", mode)
+			d := newDispatchRecorder(t)
+			defer d.Close()
+
+			in, err := os.Open("payloads/aws.v1.0.payload.json")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer in.Close()
+
+			_, err = myHandler(testContext(nil), in)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(d.events) != 1 {
+				t.Fatalf("Expected exactly one dispatch, got: %v", len(d.events))
+			}
+
+			outCE := d.events[0]
+			if outCE.EventType != MediaReceivedEventType {
+				t.Fatalf("Unexpected outbound event type: %v", outCE.EventType)
+			}
+			if outCE.EventID == "" || outCE.EventID == "C234-1234-1234" {
+				t.Fatalf("Outbound event needs an ID of its own, got: %v", outCE.EventID)
+			}
+			if outCE.Source != "http://localhost:8080/t/cloudevents/receiver" {
+				t.Fatalf("Unexpected outbound event source: %v", outCE.Source)
+			}
+			expectedExtensions := map[string]interface{}{
+				"relatedid":    "C234-1234-1234",
+				"originsource": "https://serverless.com",
+				"origintype":   "aws.s3.object.created",
+				"origintime":   "2018-04-26T14:48:09.769Z",
+				"awsregion":    "us-east-1",
+			}
+			if !reflect.DeepEqual(outCE.Extensions, expectedExtensions) {
+				t.Fatalf("Extensions mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", expectedExtensions, outCE.Extensions)
+			}
+			if outCE.Subject != "dan_kohn.jpg" {
+				t.Fatalf("Unexpected outbound event subject: %v", outCE.Subject)
+			}
+			expectedMedia := []string{"https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"}
+			if !reflect.DeepEqual(d.bodies[0].MediaURL, expectedMedia) {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", expectedMedia, d.bodies[0].MediaURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterAdapter("google.cloud.storage.object.v1.finalized", "", MediaAdapterFunc(ParseGCSData))
+	RegisterAdapter("google.storage.object.finalize", "", MediaAdapterFunc(ParseGCSData))
+	RegisterAdapter("google.cloud.storage.object.v1.deleted", "", MediaAdapterFunc(ParseGCSData))
+	RegisterAdapter("google.storage.object.delete", "", MediaAdapterFunc(ParseGCSData))
+	RegisterMediaHosts("google.cloud.storage.object.v1.finalized", gcsHosts)
+	RegisterMediaHosts("google.storage.object.finalize", gcsHosts)
+}
+
+func gcsHosts() []string {
+	return []string{"storage.googleapis.com"}
+}
+
+// GCSData is the Cloud Storage object resource
+// carried by object finalize and delete events.
+type GCSData struct {
+	Bucket      string `json:"bucket"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        string `json:"size"`
+	Generation  string `json:"generation"`
+	MD5Hash     string `json:"md5Hash"`
+	ETag        string `json:"etag"`
+	MediaLink   string `json:"mediaLink"`
+}
+
+// gcsObjectURL escapes every segment of the object name on its own,
+// so the slashes of "folder" names are kept as they are.
+func gcsObjectURL(bucket, name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s",
+		url.PathEscape(bucket), strings.Join(segments, "/"))
+}
+
+func ParseGCSData(ce *CloudEvent) ([]Media, error) {
+	b, err := json.Marshal(ce.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var d GCSData
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Bucket == "" || d.Name == "" {
+		return nil, fmt.Errorf("Cloud Storage event '%s' has no bucket or object name", ce.EventID)
+	}
+
+	// the object resource carries the size as a decimal string
+	size, _ := strconv.ParseInt(d.Size, 10, 64)
+
+	// generations grow with every version of an object,
+	// so they order its events just like S3 sequencers do
+	return []Media{{
+		URL:         gcsObjectURL(d.Bucket, d.Name),
+		ContentType: d.ContentType,
+		Size:        size,
+		Object:      "gs://" + d.Bucket + "/" + d.Name,
+		ETag:        d.ETag,
+		Sequencer:   d.Generation,
+		Deleted: ce.EventType == "google.cloud.storage.object.v1.deleted" ||
+			ce.EventType == "google.storage.object.delete",
+	}}, nil
+}
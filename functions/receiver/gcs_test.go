@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseGCSData(t *testing.T) {
+	testSuites := []struct {
+		payload  string
+		imageURL string
+	}{
+		{"payloads/gcs.payload.json",
+			"https://storage.googleapis.com/cloudevents/photos/dan%20kohn+1.jpg"},
+		{"payloads/gcs.legacy.payload.json",
+			"https://storage.googleapis.com/cloudevents/dan_kohn.jpg"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.payload, func(t *testing.T) {
+			media, err := GetMedia(loadCloudEvent(t, ts.payload))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(media) != 1 || media[0].URL != ts.imageURL {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.imageURL, media)
+			}
+		})
+	}
+}
+
+func TestGCSObjectURL(t *testing.T) {
+	testSuites := map[string]string{
+		"plain.png":       "https://storage.googleapis.com/b/plain.png",
+		"a/b/c.png":       "https://storage.googleapis.com/b/a/b/c.png",
+		"with space?.png": "https://storage.googleapis.com/b/with%20space%3F.png",
+		"100%/#hash.png":  "https://storage.googleapis.com/b/100%25/%23hash.png",
+		"über/café.jpg":   "https://storage.googleapis.com/b/%C3%BCber/caf%C3%A9.jpg",
+	}
+	for name, expected := range testSuites {
+		if actual := gcsObjectURL("b", name); actual != expected {
+			t.Fatalf("Object URL mismatch for %q!"+
+				"\n\tExpected: %v"+
+				"\n\tActual: %v", name, expected, actual)
+		}
+	}
+}
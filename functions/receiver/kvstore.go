@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVStore keeps values for a time to live. Deduplication and object tracking
+// both keep their state in one, each in a bucket of its own.
+type KVStore interface {
+	// Get returns the value of key, nil if it is unknown or expired.
+	Get(key string) ([]byte, error)
+	// Put keeps the value of key for the given time to live.
+	Put(key string, value []byte, ttl time.Duration) error
+}
+
+// newKVStore opens the store a config such as DEDUP_STORE names:
+//
+//   - memory, an in-memory LRU of capacity entries
+//   - bolt:<path>, a BoltDB file, the entries are kept in bucket
+//   - an http(s) URL of a key-value service, requests time out after timeout
+func newKVStore(config, bucket string, capacity int, timeout time.Duration) (KVStore, error) {
+	switch {
+	case config == "memory":
+		return NewMemoryKVStore(capacity), nil
+	case strings.HasPrefix(config, "bolt:"):
+		return NewBoltKVStore(strings.TrimPrefix(config, "bolt:"), bucket)
+	case strings.HasPrefix(config, "http://"), strings.HasPrefix(config, "https://"):
+		return NewHTTPKVStore(config, timeout), nil
+	}
+	return nil, fmt.Errorf("unknown store '%s'", config)
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryKVStore is a least recently used cache.
+type MemoryKVStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+func NewMemoryKVStore(capacity int) *MemoryKVStore {
+	return &MemoryKVStore{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (s *MemoryKVStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := el.Value.(*memoryEntry)
+	if time.Now().After(entry.expires) {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+		return nil, nil
+	}
+	s.lru.MoveToFront(el)
+	return append([]byte{}, entry.value...), nil
+}
+
+func (s *MemoryKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &memoryEntry{key: key, value: append([]byte{}, value...), expires: time.Now().Add(ttl)}
+	if el, ok := s.entries[key]; ok {
+		el.Value = entry
+		s.lru.MoveToFront(el)
+		return nil
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+// boltFile is a BoltDB file opened once, however many stores keep their
+// buckets in it. A second handle would wait for the lock of the first.
+type boltFile struct {
+	db   *bolt.DB
+	refs int
+}
+
+var (
+	boltFilesMu sync.Mutex
+	boltFiles   = map[string]*boltFile{}
+)
+
+func openBoltFile(path string) (*bolt.DB, error) {
+	boltFilesMu.Lock()
+	defer boltFilesMu.Unlock()
+	if f, ok := boltFiles[path]; ok {
+		f.refs++
+		return f.db, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	boltFiles[path] = &boltFile{db: db, refs: 1}
+	return db, nil
+}
+
+func closeBoltFile(path string) error {
+	boltFilesMu.Lock()
+	defer boltFilesMu.Unlock()
+	f, ok := boltFiles[path]
+	if !ok {
+		return nil
+	}
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	delete(boltFiles, path)
+	return f.db.Close()
+}
+
+// BoltKVStore keeps values along with their expiry in a bucket of a BoltDB
+// file, so they survive restarts of the function container. The expiry takes
+// the first 8 bytes of a value, so expired entries are dropped without
+// looking at the rest.
+type BoltKVStore struct {
+	path   string
+	bucket []byte
+	db     *bolt.DB
+}
+
+func NewBoltKVStore(path, bucket string) (*BoltKVStore, error) {
+	db, err := openBoltFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltKVStore{path: path, bucket: []byte(bucket), db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+		// expired entries are dropped on open rather than on every lookup
+		now := time.Now().UnixNano()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) < now {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		closeBoltFile(path)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltKVStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.bucket).Get([]byte(key))
+		if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) < time.Now().UnixNano() {
+			return nil
+		}
+		// values are only valid within the transaction
+		value = append([]byte{}, v[8:]...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	v := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Add(ttl).UnixNano()))
+	v = append(v, value...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), v)
+	})
+}
+
+func (s *BoltKVStore) Close() error {
+	return closeBoltFile(s.path)
+}
+
+// HTTPKVStore talks to a minimal key-value service: GET <url>/<key> answers
+// 200 along with the value of known keys and 404 otherwise,
+// PUT <url>/<key>?ttl=<seconds> stores a value. It stands in for whatever
+// shared store is at hand.
+type HTTPKVStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewHTTPKVStore(baseURL string, timeout time.Duration) *HTTPKVStore {
+	return &HTTPKVStore{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *HTTPKVStore) Get(key string) ([]byte, error) {
+	resp, err := s.client.Get(s.baseURL + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("store '%s' responded with status %d", s.baseURL, resp.StatusCode)
+}
+
+func (s *HTTPKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	target := s.baseURL + "/" + key + "?ttl=" + strconv.Itoa(int(ttl.Seconds()))
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("store '%s' responded with status %d", s.baseURL, resp.StatusCode)
+	}
+	return nil
+}
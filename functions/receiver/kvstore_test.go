@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testKVStore(t *testing.T, store KVStore) {
+	value, err := store.Get("a")
+	if err != nil || value != nil {
+		t.Fatalf("unknown key reported: %q, %v", value, err)
+	}
+	if err := store.Put("a", []byte("1"), time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+	value, err = store.Get("a")
+	if err != nil || !bytes.Equal(value, []byte("1")) {
+		t.Fatalf("Value mismatch!"+
+			"\n\tExpected: %q"+
+			"\n\tActual: %q, %v", "1", value, err)
+	}
+	if err := store.Put("b", []byte("1"), -time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	value, err = store.Get("b")
+	if err != nil || value != nil {
+		t.Fatalf("expired key reported: %q, %v", value, err)
+	}
+}
+
+func TestMemoryKVStore(t *testing.T) {
+	testKVStore(t, NewMemoryKVStore(10))
+
+	store := NewMemoryKVStore(2)
+	store.Put("a", []byte("1"), time.Hour)
+	store.Put("b", []byte("1"), time.Hour)
+	store.Get("a")
+	store.Put("c", []byte("1"), time.Hour)
+	if value, _ := store.Get("b"); value != nil {
+		t.Fatal("least recently used key must be evicted")
+	}
+	if value, _ := store.Get("a"); value == nil {
+		t.Fatal("recently used key must not be evicted")
+	}
+}
+
+func TestBoltKVStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receiver")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "receiver.db")
+
+	store, err := NewBoltKVStore(path, "dedup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	testKVStore(t, store)
+	store.Close()
+
+	store, err = NewBoltKVStore(path, "dedup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	if value, _ := store.Get("a"); value == nil {
+		t.Fatal("keys must survive reopening the store")
+	}
+
+	// a second store on the same file shares its handle and keeps apart
+	other, err := NewBoltKVStore(path, "objects")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Close()
+	if value, _ := other.Get("a"); value != nil {
+		t.Fatal("keys of another bucket must not be reported")
+	}
+	testKVStore(t, other)
+}
+
+func TestDedupAndObjectStoreShareBoltFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receiver")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	config := "bolt:" + filepath.Join(dir, "receiver.db")
+
+	dedup, err := newDedupStore(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	objects, err := newObjectStore(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	testDedupStore(t, dedup)
+	testObjectStore(t, objects)
+	dedup.(kvDedupStore).kv.(*BoltKVStore).Close()
+	objects.(kvObjectStore).kv.(*BoltKVStore).Close()
+}
+
+func TestHTTPKVStore(t *testing.T) {
+	type entry struct {
+		value   []byte
+		expires time.Time
+	}
+	var mu sync.Mutex
+	entries := map[string]entry{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		switch r.Method {
+		case http.MethodGet:
+			e, ok := entries[key]
+			if !ok || time.Now().After(e.expires) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(e.value)
+		case http.MethodPut:
+			ttl, _ := time.ParseDuration(r.URL.Query().Get("ttl") + "s")
+			value, _ := ioutil.ReadAll(r.Body)
+			entries[key] = entry{value: value, expires: time.Now().Add(ttl)}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	testKVStore(t, NewHTTPKVStore(srv.URL+"/", time.Second))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MappingMatch holds the event type and source patterns of a mapping,
+// where '*' matches any sequence of characters. An empty source matches any source.
+type MappingMatch struct {
+	Type   string `yaml:"type"`
+	Source string `yaml:"source"`
+}
+
+// Mapping is an adapter declared in config rather than code. It extracts
+// media from the data of events with paths such as "files.#.url":
+//
+//   - keys are separated by dots, a dot within a key is escaped as "\."
+//   - a number picks an element of an array, '#' every element
+//   - JSONPath spellings are accepted as well: "$.files[*].url", "$.files[0].url"
+//
+// Items is the path of the objects every media is extracted from, an array
+// stands for its elements. Without it media is extracted from the data itself.
+// The URL of a media is either read from the item with URL or built from
+// URLTemplate, whose "{name}" placeholders are replaced by the escaped value
+// of the named path in Fields. Object, ETag and Sequencer read the identity
+// and version of the object the object tracker orders events by, the object
+// defaults to the media URL. Hosts restricts the media URLs of the mapping,
+// see RegisterMediaHosts. The media of a Deleted mapping refers to objects
+// that are gone.
+type Mapping struct {
+	Name        string            `yaml:"name"`
+	Match       MappingMatch      `yaml:"match"`
+	Items       string            `yaml:"items"`
+	URL         string            `yaml:"url"`
+	URLTemplate string            `yaml:"urlTemplate"`
+	Fields      map[string]string `yaml:"fields"`
+	ContentType string            `yaml:"contentType"`
+	Size        string            `yaml:"size"`
+	Object      string            `yaml:"object"`
+	ETag        string            `yaml:"etag"`
+	Sequencer   string            `yaml:"sequencer"`
+	Hosts       []string          `yaml:"hosts"`
+	Deleted     bool              `yaml:"deleted"`
+}
+
+// Mappings is the set of mappings events are consulted against when no
+// adapter is registered for them, in order, the first match wins.
+type Mappings struct {
+	Mappings []*Mapping `yaml:"mappings"`
+}
+
+// MappingError is returned for an event whose data does not hold the media
+// its mapping looks for. Retrying would not change that, so it is answered
+// with a 4xx like invalid data.
+type MappingError struct {
+	Mapping string
+	EventID string
+	Reason  string
+}
+
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("mapping '%s' of event '%s': %s", e.Mapping, e.EventID, e.Reason)
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ParseMappings reads mappings in YAML, which JSON is a subset of.
+func ParseMappings(b []byte) (*Mappings, error) {
+	var ms Mappings
+	err := yaml.UnmarshalStrict(b, &ms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mappings: %s", err.Error())
+	}
+	for i, m := range ms.Mappings {
+		if m.Match.Type == "" {
+			return nil, fmt.Errorf("invalid mappings: mapping %d (%s) matches no type", i, m.Name)
+		}
+		if (m.URL == "") == (m.URLTemplate == "") {
+			return nil, fmt.Errorf("invalid mappings: mapping %d (%s) needs either url or urlTemplate", i, m.Name)
+		}
+		for _, p := range templatePlaceholder.FindAllStringSubmatch(m.URLTemplate, -1) {
+			if _, ok := m.Fields[p[1]]; !ok {
+				return nil, fmt.Errorf("invalid mappings: mapping %d (%s) has no field '%s'", i, m.Name, p[1])
+			}
+		}
+	}
+	return &ms, nil
+}
+
+// lookup returns the mapping of the event, if any.
+func (ms *Mappings) lookup(ce *CloudEvent) *Mapping {
+	for _, m := range ms.Mappings {
+		if globMatch(m.Match.Type, ce.EventType) &&
+			(m.Match.Source == "" || globMatch(m.Match.Source, ce.Source)) {
+			return m
+		}
+	}
+	return nil
+}
+
+// Media extracts the media of an event as the mapping says.
+func (m *Mapping) Media(ce *CloudEvent) ([]Media, error) {
+	data := ce.Data
+	if b, ok := data.([]byte); ok {
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, &MappingError{Mapping: m.Name, EventID: ce.EventID, Reason: "data is not JSON"}
+		}
+	} else {
+		// normalize the data to what encoding/json decodes into
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	items := []interface{}{data}
+	if m.Items != "" {
+		items = nil
+		for _, v := range extractPath(data, m.Items) {
+			if vs, ok := v.([]interface{}); ok {
+				items = append(items, vs...)
+				continue
+			}
+			items = append(items, v)
+		}
+	}
+	var media []Media
+	for _, item := range items {
+		md, err := m.mediaOf(item)
+		if err != nil {
+			return nil, &MappingError{Mapping: m.Name, EventID: ce.EventID, Reason: err.Error()}
+		}
+		media = append(media, md...)
+	}
+	if len(media) == 0 {
+		return nil, &MappingError{Mapping: m.Name, EventID: ce.EventID, Reason: "no media found"}
+	}
+	return media, nil
+}
+
+func (m *Mapping) mediaOf(item interface{}) ([]Media, error) {
+	var urls []string
+	if m.URL != "" {
+		urls = extractStrings(item, m.URL)
+	} else {
+		u, err := m.expand(item)
+		if err != nil {
+			return nil, err
+		}
+		urls = []string{u}
+	}
+
+	var size int64
+	if m.Size != "" {
+		if vs := extractStrings(item, m.Size); len(vs) > 0 {
+			n, err := strconv.ParseInt(vs[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size '%s'", vs[0])
+			}
+			size = n
+		}
+	}
+
+	media := make([]Media, 0, len(urls))
+	for _, u := range urls {
+		md := Media{URL: u, ContentType: firstString(item, m.ContentType), Size: size, Deleted: m.Deleted}
+		// the object and version of an item only describe the media of a single URL
+		if len(urls) == 1 {
+			md.Object = firstString(item, m.Object)
+			md.ETag = firstString(item, m.ETag)
+			md.Sequencer = firstString(item, m.Sequencer)
+		}
+		if md.Object == "" {
+			md.Object = withoutQuery(u)
+		}
+		media = append(media, md)
+	}
+	return media, nil
+}
+
+// firstString returns the first scalar value a path points at, if any.
+func firstString(item interface{}, p string) string {
+	if p == "" {
+		return ""
+	}
+	if vs := extractStrings(item, p); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// expand fills in the URL template. Values are escaped as paths,
+// slashes are kept so object keys end up as they are stored.
+func (m *Mapping) expand(item interface{}) (string, error) {
+	var missing string
+	u := templatePlaceholder.ReplaceAllStringFunc(m.URLTemplate, func(p string) string {
+		name := p[1 : len(p)-1]
+		vs := extractStrings(item, m.Fields[name])
+		if len(vs) == 0 || vs[0] == "" {
+			if missing == "" {
+				missing = name
+			}
+			return ""
+		}
+		segments := strings.Split(vs[0], "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		return strings.Join(segments, "/")
+	})
+	if missing != "" {
+		return "", fmt.Errorf("field '%s' is missing", missing)
+	}
+	return u, nil
+}
+
+// splitPath splits a path into its keys, turning JSONPath spellings
+// into the dotted ones.
+func splitPath(p string) []string {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	p = strings.NewReplacer("[*]", ".#", "[", ".", "]", "").Replace(p)
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch {
+		case p[i] == '\\' && i+1 < len(p):
+			i++
+			key.WriteByte(p[i])
+		case p[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(p[i])
+		}
+	}
+	return append(keys, key.String())
+}
+
+// extractPath returns the values a path points at, several of them
+// when it goes through every element of an array.
+func extractPath(v interface{}, p string) []interface{} {
+	values := []interface{}{v}
+	for _, key := range splitPath(p) {
+		if key == "" {
+			continue
+		}
+		var next []interface{}
+		for _, v := range values {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				if child, ok := v[key]; ok && child != nil {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if key == "#" {
+					next = append(next, v...)
+				} else if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(v) {
+					next = append(next, v[i])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+// extractStrings returns the scalar values a path points at as strings.
+func extractStrings(v interface{}, p string) []string {
+	var s []string
+	for _, v := range extractPath(v, p) {
+		switch v := v.(type) {
+		case string:
+			s = append(s, v)
+		case float64:
+			s = append(s, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			s = append(s, strconv.FormatBool(v))
+		}
+	}
+	return s
+}
+
+var (
+	mappingsOnce sync.Once
+	mappings     *Mappings
+	mappingsErr  error
+)
+
+// getMappings loads the mappings from the MAPPINGS config or the file
+// MAPPINGS_FILE points at. Without either there are none.
+func getMappings() (*Mappings, error) {
+	mappingsOnce.Do(func() {
+		mappings, mappingsErr = loadMappings()
+		if mappingsErr != nil {
+			log.Println("unable to load mappings: ", mappingsErr.Error())
+		}
+	})
+	return mappings, mappingsErr
+}
+
+func loadMappings() (*Mappings, error) {
+	if ms := os.Getenv("MAPPINGS"); ms != "" {
+		return ParseMappings([]byte(ms))
+	}
+	if file := os.Getenv("MAPPINGS_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMappings(b)
+	}
+	return &Mappings{}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadExampleMappings(t *testing.T) *Mappings {
+	b, err := ioutil.ReadFile("mappings.example.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ms, err := ParseMappings(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return ms
+}
+
+func TestExtractPath(t *testing.T) {
+	data := map[string]interface{}{
+		"files": []interface{}{
+			map[string]interface{}{"url": "a", "size": float64(1)},
+			map[string]interface{}{"url": "b", "size": float64(2)},
+		},
+		"a.b": map[string]interface{}{"c": true},
+	}
+
+	testSuites := []struct {
+		path     string
+		expected []string
+	}{
+		{"files.#.url", []string{"a", "b"}},
+		{"files.1.url", []string{"b"}},
+		{"files.#.size", []string{"1", "2"}},
+		{"$.files[*].url", []string{"a", "b"}},
+		{"$.files[0].url", []string{"a"}},
+		{`a\.b.c`, []string{"true"}},
+		{"files.2.url", nil},
+		{"missing", nil},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.path, func(t *testing.T) {
+			actual := extractStrings(data, ts.path)
+			if !reflect.DeepEqual(actual, ts.expected) {
+				t.Fatalf("Values mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMappingMedia(t *testing.T) {
+	ms := loadExampleMappings(t)
+
+	testSuites := []struct {
+		name     string
+		ce       *CloudEvent
+		expected []Media
+	}{
+		{"url", &CloudEvent{
+			EventType: "com.example.cms.asset.published",
+			Source:    "https://cms.example.com/sites/1",
+			Data: map[string]interface{}{"assets": []interface{}{
+				map[string]interface{}{"href": "https://assets.example.com/a.jpg", "mimeType": "image/jpeg", "bytes": 1024},
+				map[string]interface{}{"href": "https://assets.example.com/b.png"},
+			}},
+		}, []Media{
+			{URL: "https://assets.example.com/a.jpg", ContentType: "image/jpeg", Size: 1024, Object: "https://assets.example.com/a.jpg"},
+			{URL: "https://assets.example.com/b.png", Object: "https://assets.example.com/b.png"},
+		}},
+		{"template", &CloudEvent{
+			EventType: "com.example.files.added",
+			Data: []byte(`{"entries": [{"id": "id:42", "path_display": "Photos/fn project.jpg", "size": 7,
+				"content_hash": "e3b0c442", "rev": "015f9a3c2b"}]}`),
+		}, []Media{
+			{URL: "https://content.example.com/id:42/Photos/fn%20project.jpg", Size: 7,
+				Object: "id:42", ETag: "e3b0c442", Sequencer: "015f9a3c2b"},
+		}},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			m := ms.lookup(ts.ce)
+			if m == nil {
+				t.Fatalf("No mapping for %s", ts.ce.EventType)
+			}
+			media, err := m.Media(ts.ce)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(media, ts.expected) {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.expected, media)
+			}
+		})
+	}
+
+	other := &CloudEvent{EventType: "com.example.cms.asset.published", Source: "https://other.example.com"}
+	if m := ms.lookup(other); m != nil {
+		t.Fatalf("Unexpected mapping for source %s: %v", other.Source, m.Name)
+	}
+}
+
+func TestMappingMediaMissing(t *testing.T) {
+	ms := loadExampleMappings(t)
+
+	testSuites := []struct {
+		name string
+		ce   *CloudEvent
+	}{
+		{"no-items", &CloudEvent{EventType: "com.example.files.added", Data: map[string]interface{}{}}},
+		{"no-field", &CloudEvent{EventType: "com.example.files.added",
+			Data: map[string]interface{}{"entries": []interface{}{map[string]interface{}{"id": "1"}}}}},
+		{"not-json", &CloudEvent{EventType: "com.example.files.added", Data: []byte("<xml/>")}},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			_, err := ms.lookup(ts.ce).Media(ts.ce)
+			if _, ok := err.(*MappingError); !ok {
+				t.Fatalf("Expected a mapping error, got: %v", err)
+			}
+			if statusCode(err) != http.StatusUnprocessableEntity {
+				t.Fatalf("Unexpected status code: %v", statusCode(err))
+			}
+		})
+	}
+}
+
+func TestParseMappingsInvalid(t *testing.T) {
+	testSuites := []struct {
+		name     string
+		mappings string
+	}{
+		{"no-type", "mappings: [{name: a, url: u}]"},
+		{"no-url", "mappings: [{name: a, match: {type: t}}]"},
+		{"both-urls", "mappings: [{name: a, match: {type: t}, url: u, urlTemplate: 'https://x/{id}', fields: {id: id}}]"},
+		{"unknown-field", "mappings: [{name: a, match: {type: t}, urlTemplate: 'https://x/{id}'}]"},
+		{"unknown-key", "mappings: [{name: a, match: {type: t}, url: u, target: /x}]"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			if _, err := ParseMappings([]byte(ts.mappings)); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
+
+func TestMyHandlerMapping(t *testing.T) {
+	getMappings()
+	mappings = loadExampleMappings(t)
+	defer func() { mappings = &Mappings{} }()
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	payload := `{"specversion": "1.0", "type": "com.example.cms.asset.published", "id": "1",
+		"source": "https://cms.example.com/sites/1",
+		"data": {"assets": [{"href": "https://assets.example.com/a.jpg"}, {"href": "https://evil.example.com/b.jpg"}]}}`
+	resp, err := myHandler(testContext(nil), strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(d.bodies) != 1 || !reflect.DeepEqual(d.bodies[0].MediaURL, []string{"https://assets.example.com/a.jpg"}) {
+		t.Fatalf("Unexpected dispatch: %v", d.bodies)
+	}
+	rejected := resp.(*HandlerResponse).Events[0].Rejected
+	if len(rejected) != 1 || rejected[0].URL != "https://evil.example.com/b.jpg" {
+		t.Fatalf("Expected the media of other hosts to be rejected, got: %v", rejected)
+	}
+}
+
+func TestMyHandlerMappingOrder(t *testing.T) {
+	getMappings()
+	mappings = loadExampleMappings(t)
+	defer func() { mappings = &Mappings{} }()
+	getObjectStore()
+	objectStore = NewObjectStore(NewMemoryKVStore(10))
+	defer func() { objectStore = nil }()
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	event := func(id, rev string) string {
+		return `{"specversion": "1.0", "type": "com.example.files.added", "id": "` + id + `",
+			"source": "https://files.example.com",
+			"data": {"entries": [{"id": "id:42", "path_display": "a.jpg", "rev": "` + rev + `"}]}}`
+	}
+	for _, payload := range []string{event("1", "02"), event("2", "01")} {
+		if _, err := myHandler(testContext(nil), strings.NewReader(payload)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(d.bodies) != 1 {
+		t.Fatalf("Expected the older revision to be skipped, dispatched: %v", d.bodies)
+	}
+
+	_, err := myHandler(testContext(nil), strings.NewReader(`{"specversion": "1.0", "type": "com.example.files.added",
+		"id": "3", "source": "https://files.example.com", "data": {}}`))
+	if statusCode(err) != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected an event without media to be rejected with 422, got: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaOutOfOrder counts the media that arrived after a newer version
+// of its object had been dispatched.
+var mediaOutOfOrder = expvar.NewInt("media_out_of_order")
+
+// ObjectState is what the receiver last dispatched of a stored object.
+// Time is the time of the event, which orders the events of objects
+// without sequencers.
+type ObjectState struct {
+	ETag      string    `json:"etag,omitempty"`
+	Sequencer string    `json:"sequencer,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// ObjectStore remembers the state of the objects the receiver dispatched
+// media of, so it can tell new versions of an object from ones it has seen.
+type ObjectStore interface {
+	// Get returns the state of an object, nil if it is unknown or expired.
+	Get(object string) (*ObjectState, error)
+	// Put remembers the state of an object for the given time to live.
+	Put(object string, state *ObjectState, ttl time.Duration) error
+}
+
+var (
+	objectStoreOnce sync.Once
+	objectStore     ObjectStore
+)
+
+// getObjectStore returns the store configured through OBJECT_STORE,
+// or nil when objects are not tracked:
+//
+//   - memory, an in-memory LRU of OBJECT_STORE_CAPACITY objects
+//   - bolt:<path>, a BoltDB file, which may be the one of DEDUP_STORE
+//   - an http(s) URL of a key-value service
+//
+// The store lives as long as the function container does.
+func getObjectStore() ObjectStore {
+	objectStoreOnce.Do(func() {
+		store, err := newObjectStore(os.Getenv("OBJECT_STORE"))
+		if err != nil {
+			log.Println("object tracking is disabled: ", err.Error())
+			return
+		}
+		objectStore = store
+	})
+	return objectStore
+}
+
+func newObjectStore(config string) (ObjectStore, error) {
+	if config == "" {
+		return nil, fmt.Errorf("OBJECT_STORE is not set")
+	}
+	kv, err := newKVStore(config, "objects",
+		intWithDefault("OBJECT_STORE_CAPACITY", 10000), durationWithDefault("OBJECT_STORE_TIMEOUT", 5*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("OBJECT_STORE: %s", err.Error())
+	}
+	return NewObjectStore(kv), nil
+}
+
+// kvObjectStore keeps object states as JSON in a KVStore, keyed by hashes
+// of the objects.
+type kvObjectStore struct {
+	kv KVStore
+}
+
+// NewObjectStore remembers object states in kv.
+func NewObjectStore(kv KVStore) ObjectStore {
+	return kvObjectStore{kv: kv}
+}
+
+func objectKey(object string) string {
+	h := sha256.Sum256([]byte(object))
+	return hex.EncodeToString(h[:])
+}
+
+func (s kvObjectStore) Get(object string) (*ObjectState, error) {
+	v, err := s.kv.Get(objectKey(object))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	state := &ObjectState{}
+	if err := json.Unmarshal(v, state); err != nil {
+		return nil, fmt.Errorf("object store holds an invalid state: %s", err.Error())
+	}
+	return state, nil
+}
+
+func (s kvObjectStore) Put(object string, state *ObjectState, ttl time.Duration) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.kv.Put(objectKey(object), b, ttl)
+}
+
+// compareSequencers orders two sequencers of the same object. S3 sequencers
+// are hexadecimal strings of varying length that compare lexicographically
+// once the shorter one is left-padded with zeros, which holds for the
+// sequencers of Azure and the decimal generations of Cloud Storage as well.
+func compareSequencers(a, b string) int {
+	if len(a) < len(b) {
+		a = strings.Repeat("0", len(b)-len(a)) + a
+	} else if len(b) < len(a) {
+		b = strings.Repeat("0", len(a)-len(b)) + b
+	}
+	return strings.Compare(strings.ToUpper(a), strings.ToUpper(b))
+}
+
+const (
+	outOfOrderDrop = "drop"
+	outOfOrderFlag = "flag"
+)
+
+// ObjectTracker orders the events of every object and detects overwrites:
+// media of an object the receiver dispatched before is either a new version,
+// which is flagged as such, or one that is not worth processing again.
+// Media older than the version dispatched last is dropped or, with
+// flagOutOfOrder, dispatched but flagged as out of order.
+type ObjectTracker struct {
+	store          ObjectStore
+	ttl            time.Duration
+	flagOutOfOrder bool
+}
+
+func objectTrackerFromConfig() ObjectTracker {
+	mode := withDefault("OUT_OF_ORDER", outOfOrderDrop)
+	if mode != outOfOrderDrop && mode != outOfOrderFlag {
+		log.Printf("unknown OUT_OF_ORDER '%s', falling back to '%s'\n", mode, outOfOrderDrop)
+	}
+	return ObjectTracker{
+		store:          getObjectStore(),
+		ttl:            durationWithDefault("OBJECT_STORE_TTL", 7*24*time.Hour),
+		flagOutOfOrder: mode == outOfOrderFlag,
+	}
+}
+
+// order tells whether media of an event of the given time is older (< 0),
+// the same (0) or newer (> 0) than the state of its object. Sequencers are
+// preferred, event times only order events of different times. ok is false
+// when there is no telling.
+func order(m *Media, eventTime time.Time, prev *ObjectState) (c int, ok bool) {
+	if m.Sequencer != "" && prev.Sequencer != "" {
+		return compareSequencers(m.Sequencer, prev.Sequencer), true
+	}
+	if eventTime.IsZero() || prev.Time.IsZero() || eventTime.Equal(prev.Time) {
+		return 0, false
+	}
+	if eventTime.Before(prev.Time) {
+		return -1, true
+	}
+	return 1, true
+}
+
+// check returns why media of the event must not be dispatched, or an empty
+// string. Media without an object identity or a previous state always passes.
+func (t ObjectTracker) check(ce *CloudEvent, m *Media) string {
+	if t.store == nil || m.Object == "" {
+		return ""
+	}
+	prev, err := t.store.Get(m.Object)
+	if err != nil {
+		log.Printf("unable to look up object '%s': %s\n", m.Object, err.Error())
+		return ""
+	}
+	if prev == nil {
+		return ""
+	}
+
+	if c, ok := order(m, ce.EventTime, prev); ok {
+		switch {
+		case c < 0:
+			mediaOutOfOrder.Add(1)
+			log.Printf("media '%s' of event '%s' is out of order, %d so far\n",
+				m.Object, ce.EventID, mediaOutOfOrder.Value())
+			if t.flagOutOfOrder {
+				m.OutOfOrder = true
+				return ""
+			}
+			if m.Sequencer != "" && prev.Sequencer != "" {
+				return fmt.Sprintf("superseded by sequencer %s", prev.Sequencer)
+			}
+			return fmt.Sprintf("superseded by an event of %s", prev.Time.Format(time.RFC3339Nano))
+		case c == 0:
+			return "already dispatched"
+		}
+	}
+	if m.OutOfOrder {
+		return ""
+	}
+	if m.Deleted || prev.Deleted {
+		if m.Deleted && prev.Deleted {
+			return "already deleted"
+		}
+		return ""
+	}
+	if m.ETag != "" && m.ETag == prev.ETag {
+		return "object unchanged"
+	}
+	m.Overwrite = true
+	return ""
+}
+
+// Apply splits the media of an event into what is to be dispatched, with
+// overwrites and media out of order flagged, and what is skipped as stale
+// or unchanged.
+func (t ObjectTracker) Apply(ce *CloudEvent, media []Media) (kept []Media, skipped []SkippedMedia) {
+	for _, m := range media {
+		if reason := t.check(ce, &m); reason != "" {
+			log.Printf("skipping media '%s': %s\n", m.URL, reason)
+			skipped = append(skipped, SkippedMedia{URL: m.reference(), Reason: reason})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, skipped
+}
+
+// Remember records the state of the dispatched media of an event. It must
+// only be called once dispatch succeeded, a redelivery would be skipped
+// otherwise. Media out of order leaves the newer state as it is.
+func (t ObjectTracker) Remember(ce *CloudEvent, media []Media) {
+	if t.store == nil {
+		return
+	}
+	for _, m := range media {
+		if m.Object == "" || m.OutOfOrder {
+			continue
+		}
+		state := &ObjectState{ETag: m.ETag, Sequencer: m.Sequencer, Time: ce.EventTime, Deleted: m.Deleted}
+		if err := t.store.Put(m.Object, state, t.ttl); err != nil {
+			log.Printf("unable to remember object '%s': %s\n", m.Object, err.Error())
+		}
+	}
+}
+
+// splitDeleted separates the media of deleted objects from the rest.
+func splitDeleted(media []Media) (present, deleted []Media) {
+	for _, m := range media {
+		if m.Deleted {
+			deleted = append(deleted, m)
+			continue
+		}
+		present = append(present, m)
+	}
+	return present, deleted
+}
+
+// cleanup dispatches an io.fnproject.media.deleted event for deleted media to
+// CLEANUP_TARGET, a function path or an invoke URL, and returns the target.
+// Without a cleanup target there is nothing to do.
+func cleanup(ctx context.Context, ce *CloudEvent, deleted []Media) (string, error) {
+	target := os.Getenv("CLEANUP_TARGET")
+	if target == "" {
+		log.Printf("no CLEANUP_TARGET for the deleted media of event '%s'\n", ce.EventID)
+		return "", nil
+	}
+	outCE := NewMediaDeletedEvent(ctx, ce, deleted)
+	return target, dispatchEvent(ctx, ce, outCE, outCE, target)
+}
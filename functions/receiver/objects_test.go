@@ -0,0 +1,270 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testObjectStore(t *testing.T, store ObjectStore) {
+	state, err := store.Get("s3://b/a")
+	if err != nil || state != nil {
+		t.Fatalf("unknown object reported: %v, %v", state, err)
+	}
+	expected := &ObjectState{ETag: "1", Sequencer: "0A", Time: time.Date(2018, 4, 26, 14, 48, 9, 0, time.UTC)}
+	if err := store.Put("s3://b/a", expected, time.Hour); err != nil {
+		t.Fatal(err.Error())
+	}
+	state, err = store.Get("s3://b/a")
+	if err != nil || !reflect.DeepEqual(state, expected) {
+		t.Fatalf("State mismatch!"+
+			"\n\tExpected: %+v"+
+			"\n\tActual: %+v, %v", expected, state, err)
+	}
+	if err := store.Put("s3://b/b", expected, -time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	state, err = store.Get("s3://b/b")
+	if err != nil || state != nil {
+		t.Fatalf("expired object reported: %v, %v", state, err)
+	}
+}
+
+func TestObjectStore(t *testing.T) {
+	testObjectStore(t, NewObjectStore(NewMemoryKVStore(10)))
+}
+
+func TestCompareSequencers(t *testing.T) {
+	testSuites := []struct {
+		a, b     string
+		expected int
+	}{
+		{"005AE1E6A9A3D61490", "005AE1E6A9A3D61491", -1},
+		{"005AE1E6A9A3D61491", "005AE1E6A9A3D61490", 1},
+		{"005AE1E6A9A3D61490", "005ae1e6a9a3d61490", 0},
+		{"5AE1E6A9A3D61490", "005AE1E6A9A3D61490", 0},
+		{"FF", "0100", -1},
+		{"1524754089769000", "999", 1},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.a+"-"+ts.b, func(t *testing.T) {
+			if actual := compareSequencers(ts.a, ts.b); actual != ts.expected {
+				t.Fatalf("Unexpected order of %s and %s: %v", ts.a, ts.b, actual)
+			}
+		})
+	}
+}
+
+func TestObjectTracker(t *testing.T) {
+	tracker := ObjectTracker{store: NewObjectStore(NewMemoryKVStore(10)), ttl: time.Hour}
+	ce := &CloudEvent{}
+	tracker.Remember(ce, []Media{
+		{URL: "a", Object: "s3://b/a", ETag: "1", Sequencer: "0A"},
+		{URL: "d", Object: "s3://b/d", Sequencer: "0A", Deleted: true},
+		{URL: "o", Object: "oci://n/b/o", ETag: "1"},
+	})
+
+	testSuites := []struct {
+		name      string
+		media     Media
+		reason    string
+		overwrite bool
+	}{
+		{"unknown", Media{Object: "s3://b/x", ETag: "1", Sequencer: "01"}, "", false},
+		{"no-object", Media{URL: "u"}, "", false},
+		{"overwrite", Media{Object: "s3://b/a", ETag: "2", Sequencer: "0B"}, "", true},
+		{"redelivery", Media{Object: "s3://b/a", ETag: "1", Sequencer: "0A"}, "already dispatched", false},
+		{"superseded", Media{Object: "s3://b/a", ETag: "0", Sequencer: "09"}, "superseded by sequencer 0A", false},
+		{"superseded-deletion", Media{Object: "s3://b/a", Sequencer: "09", Deleted: true}, "superseded by sequencer 0A", false},
+		{"deletion", Media{Object: "s3://b/a", Sequencer: "0B", Deleted: true}, "", false},
+		{"recreated", Media{Object: "s3://b/d", ETag: "1", Sequencer: "0B"}, "", false},
+		{"unchanged", Media{Object: "oci://n/b/o", ETag: "1"}, "object unchanged", false},
+		{"changed", Media{Object: "oci://n/b/o", ETag: "2"}, "", true},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			m := ts.media
+			if reason := tracker.check(ce, &m); reason != ts.reason || m.Overwrite != ts.overwrite {
+				t.Fatalf("Check mismatch!"+
+					"\n\tExpected: %q %v"+
+					"\n\tActual: %q %v", ts.reason, ts.overwrite, reason, m.Overwrite)
+			}
+		})
+	}
+
+	t.Run("no-store", func(t *testing.T) {
+		m := Media{Object: "s3://b/a", ETag: "1", Sequencer: "0A"}
+		if reason := (ObjectTracker{}).check(ce, &m); reason != "" {
+			t.Fatalf("Expected media to pass without a store, got: %v", reason)
+		}
+	})
+}
+
+func TestObjectTrackerOrder(t *testing.T) {
+	earlier := time.Date(2019, 10, 15, 17, 33, 26, 0, time.UTC)
+	later := earlier.Add(time.Minute)
+	oci := Media{URL: "o", Object: "oci://n/b/o", ETag: "1"}
+
+	testSuites := []struct {
+		name       string
+		flag       bool
+		time       time.Time
+		etag       string
+		reason     string
+		outOfOrder bool
+	}{
+		{"older", false, earlier, "2", "superseded by an event of 2019-10-15T17:34:26Z", false},
+		{"older-flagged", true, earlier, "2", "", true},
+		{"same-time", false, later, "1", "object unchanged", false},
+		{"newer", false, later.Add(time.Minute), "2", "", false},
+		{"no-time", false, time.Time{}, "1", "object unchanged", false},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			tracker := ObjectTracker{store: NewObjectStore(NewMemoryKVStore(10)), ttl: time.Hour, flagOutOfOrder: ts.flag}
+			tracker.Remember(&CloudEvent{EventTime: later}, []Media{oci})
+
+			m := oci
+			m.ETag = ts.etag
+			ce := &CloudEvent{EventTime: ts.time}
+			if reason := tracker.check(ce, &m); reason != ts.reason || m.OutOfOrder != ts.outOfOrder {
+				t.Fatalf("Check mismatch!"+
+					"\n\tExpected: %q %v"+
+					"\n\tActual: %q %v", ts.reason, ts.outOfOrder, reason, m.OutOfOrder)
+			}
+
+			// media out of order must not replace the newer state
+			tracker.Remember(ce, []Media{m})
+			if state, _ := tracker.store.Get(oci.Object); ts.outOfOrder && !state.Time.Equal(later) {
+				t.Fatalf("Newer state replaced: %+v", state)
+			}
+		})
+	}
+}
+
+func TestDeletedMedia(t *testing.T) {
+	testSuites := []struct {
+		name     string
+		ce       *CloudEvent
+		expected Media
+	}{
+		{"s3", &CloudEvent{EventType: "aws.s3.object.deleted", Data: map[string]interface{}{
+			"awsRegion": "us-west-2",
+			"bucket":    map[string]interface{}{"name": "cloudevents"},
+			"object":    map[string]interface{}{"key": "old.jpg", "sequencer": "005AE1E6A9A3D61492"},
+		}}, Media{
+			URL:       "https://s3.us-west-2.amazonaws.com/cloudevents/old.jpg",
+			Object:    "s3://cloudevents/old.jpg",
+			Sequencer: "005AE1E6A9A3D61492",
+			Deleted:   true,
+		}},
+		{"azure", &CloudEvent{EventType: "Microsoft.Storage.BlobDeleted", Data: map[string]interface{}{
+			"url":       "https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg",
+			"sequencer": "000000000000000000000000000000BA00000000003db46d",
+		}}, Media{
+			URL:       "https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg",
+			Object:    "https://cvtest34.blob.core.windows.net/myfiles/IMG_20180224_0004.jpg",
+			Sequencer: "000000000000000000000000000000BA00000000003db46d",
+			Deleted:   true,
+		}},
+		{"gcs", &CloudEvent{EventType: "google.cloud.storage.object.v1.deleted", Data: map[string]interface{}{
+			"bucket": "cloudevents", "name": "photos/a.jpg", "generation": "1524754089769000",
+		}}, Media{
+			URL:       "https://storage.googleapis.com/cloudevents/photos/a.jpg",
+			Object:    "gs://cloudevents/photos/a.jpg",
+			Sequencer: "1524754089769000",
+			Deleted:   true,
+		}},
+		{"oci", &CloudEvent{EventType: "com.oraclecloud.objectstorage.deleteobject",
+			Extensions: map[string]interface{}{"region": "us-ashburn-1"},
+			Data: map[string]interface{}{
+				"resourceName":      "photos/a.jpg",
+				"additionalDetails": map[string]interface{}{"namespace": "fnproject", "bucketName": "cloudevents"},
+			}}, Media{
+			URL:     "https://objectstorage.us-ashburn-1.oraclecloud.com/n/fnproject/b/cloudevents/o/photos%2Fa.jpg",
+			Object:  "oci://fnproject/cloudevents/photos/a.jpg",
+			Deleted: true,
+		}},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			media, err := GetMedia(ts.ce)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(media, []Media{ts.expected}) {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %+v"+
+					"\n\tActual: %+v", ts.expected, media)
+			}
+		})
+	}
+}
+
+func TestMyHandlerCleanupAndOverwrite(t *testing.T) {
+	getObjectStore()
+	objectStore = NewObjectStore(NewMemoryKVStore(10))
+	defer func() { objectStore = nil }()
+	os.Setenv("CLEANUP_TARGET", "/media-cleanup")
+	defer os.Unsetenv("CLEANUP_TARGET")
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	in, err := os.Open("payloads/aws.notification.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	resp, err := myHandler(testContext(nil), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(d.events) != 2 || d.events[0].EventType != MediaDeletedEventType ||
+		d.requests[0].URL.Path != "/t/cloudevents/media-cleanup" {
+		t.Fatalf("Expected the removed object to go to the cleanup target first, got: %v", d.events)
+	}
+	expected := []string{"https://s3.us-west-2.amazonaws.com/cloudevents/old.jpg"}
+	if !reflect.DeepEqual(d.bodies[0].MediaURL, expected) {
+		t.Fatalf("Dispatch mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, d.bodies[0].MediaURL)
+	}
+	targets := resp.(*HandlerResponse).Events[0].Targets
+	if !reflect.DeepEqual(targets, []string{"/media-cleanup", "/image-processor"}) {
+		t.Fatalf("Unexpected targets: %v", targets)
+	}
+
+	t.Run("redelivery", func(t *testing.T) {
+		in.Seek(0, 0)
+		resp, err := myHandler(testContext(nil), in)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		outcome := resp.(*HandlerResponse).Events[0]
+		if len(d.events) != 2 || outcome.Status != statusSkipped || len(outcome.Skipped) != 3 {
+			t.Fatalf("Expected the redelivery to be skipped, got: %+v", outcome)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		payload := `{"specversion": "1.0", "type": "aws.s3.object.created", "id": "2", "source": "s",
+			"data": {"awsRegion": "us-west-2", "bucket": {"name": "cloudevents"},
+				"object": {"key": "dan_kohn.jpg", "sequencer": "005AE1E6A9A3D614A0", "eTag": "0cc175b9c0f1b6a831c399e269772661"}}}`
+		_, err := myHandler(testContext(nil), strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := []string{"https://s3.us-west-2.amazonaws.com/cloudevents/dan_kohn.jpg"}
+		if len(d.bodies) != 3 || !reflect.DeepEqual(d.bodies[2].Overwrites, expected) {
+			t.Fatalf("Expected the overwrite to be flagged, got: %+v", d.bodies[len(d.bodies)-1])
+		}
+	})
+}
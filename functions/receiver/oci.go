@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterAdapter("com.oraclecloud.objectstorage.createobject", "", MediaAdapterFunc(ParseOCIData))
+	RegisterAdapter("com.oraclecloud.objectstorage.deleteobject", "", MediaAdapterFunc(ParseOCIData))
+	RegisterMediaHosts("com.oraclecloud.objectstorage.*", func() []string {
+		if par := os.Getenv("OCI_PAR_URL"); par != "" {
+			return hostOf(par)
+		}
+		return []string{"objectstorage.*.oraclecloud.com"}
+	})
+}
+
+type OCIAdditionalDetails struct {
+	Namespace  string `json:"namespace"`
+	BucketName string `json:"bucketName"`
+	BucketID   string `json:"bucketId"`
+	ETag       string `json:"eTag"`
+}
+
+type OCIData struct {
+	CompartmentID     string               `json:"compartmentId"`
+	ResourceName      string               `json:"resourceName"`
+	ResourceID        string               `json:"resourceId"`
+	AdditionalDetails OCIAdditionalDetails `json:"additionalDetails"`
+}
+
+// ociRegion prefers the region an event carries as an extension
+// and falls back to the OCI_REGION config.
+func ociRegion(ce *CloudEvent) string {
+	if region, ok := ce.Extensions["region"].(string); ok && region != "" {
+		return region
+	}
+	return os.Getenv("OCI_REGION")
+}
+
+// parBucket returns the namespace and bucket of a bucket pre-authenticated
+// request URL, which has the path /p/<token>/n/<namespace>/b/<bucket>/o/.
+func parBucket(par string) (namespace, bucket string, ok bool) {
+	u, err := url.Parse(par)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 6 || parts[0] != "p" || parts[2] != "n" || parts[4] != "b" {
+		return "", "", false
+	}
+	return parts[3], parts[5], true
+}
+
+// ociObjectURL builds the URL of an object, either through the bucket
+// pre-authenticated request configured as OCI_PAR_URL or as a native
+// Object Storage URL. Object names are escaped as a whole, slashes included.
+// A pre-authenticated request only reaches the objects of its own bucket,
+// objects of any other are rejected.
+func ociObjectURL(region, namespace, bucket, object string) (string, error) {
+	if par := os.Getenv("OCI_PAR_URL"); par != "" {
+		parNamespace, parBucketName, ok := parBucket(par)
+		if !ok || parNamespace != namespace || parBucketName != bucket {
+			return "", &URLPolicyError{
+				URL:    "oci://" + namespace + "/" + bucket + "/" + object,
+				Reason: "object is not in the bucket of OCI_PAR_URL",
+			}
+		}
+		if !strings.HasSuffix(par, "/") {
+			par += "/"
+		}
+		return par + url.PathEscape(object), nil
+	}
+	if region == "" {
+		return "", fmt.Errorf("unable to build Object Storage URL: " +
+			"region is neither part of the event nor set as OCI_REGION")
+	}
+	return fmt.Sprintf("https://objectstorage.%s.oraclecloud.com/n/%s/b/%s/o/%s",
+		region, url.PathEscape(namespace), url.PathEscape(bucket), url.PathEscape(object)), nil
+}
+
+func ParseOCIData(ce *CloudEvent) ([]Media, error) {
+	b, err := json.Marshal(ce.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var d OCIData
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return nil, err
+	}
+	details := d.AdditionalDetails
+	if d.ResourceName == "" || details.Namespace == "" || details.BucketName == "" {
+		return nil, fmt.Errorf("Object Storage event '%s' has no "+
+			"namespace, bucket or object name", ce.EventID)
+	}
+
+	imgURL, err := ociObjectURL(ociRegion(ce), details.Namespace, details.BucketName, d.ResourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Media{{
+		URL:     imgURL,
+		Object:  "oci://" + details.Namespace + "/" + details.BucketName + "/" + d.ResourceName,
+		ETag:    details.ETag,
+		Deleted: ce.EventType == "com.oraclecloud.objectstorage.deleteobject",
+	}}, nil
+}
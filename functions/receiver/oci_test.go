@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseOCIData(t *testing.T) {
+	defer os.Unsetenv("OCI_REGION")
+	defer os.Unsetenv("OCI_PAR_URL")
+
+	testSuites := []struct {
+		name     string
+		region   string
+		par      string
+		imageURL string
+	}{
+		{"native", "us-ashburn-1", "",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/n/fnproject/b/cloudevents/o/photos%2Fdan_kohn.jpg"},
+		{"pre-authenticated", "us-ashburn-1",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/fnproject/b/cloudevents/o",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/fnproject/b/cloudevents/o/photos%2Fdan_kohn.jpg"},
+		{"pre-authenticated-without-region", "",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/fnproject/b/cloudevents/o/",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/fnproject/b/cloudevents/o/photos%2Fdan_kohn.jpg"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			os.Setenv("OCI_REGION", ts.region)
+			os.Setenv("OCI_PAR_URL", ts.par)
+			media, err := GetMedia(loadCloudEvent(t, "payloads/oci.payload.json"))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if len(media) != 1 || media[0].URL != ts.imageURL {
+				t.Fatalf("Media mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.imageURL, media)
+			}
+		})
+	}
+
+	t.Run("region-from-extension", func(t *testing.T) {
+		os.Setenv("OCI_REGION", "us-ashburn-1")
+		os.Setenv("OCI_PAR_URL", "")
+		ce := loadCloudEvent(t, "payloads/oci.payload.json")
+		ce.Extensions["region"] = "eu-frankfurt-1"
+		media, err := GetMedia(ce)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := "https://objectstorage.eu-frankfurt-1.oraclecloud.com/n/fnproject/b/cloudevents/o/photos%2Fdan_kohn.jpg"
+		if media[0].URL != expected {
+			t.Fatalf("Media mismatch!"+
+				"\n\tExpected: %v"+
+				"\n\tActual: %v", expected, media[0].URL)
+		}
+	})
+
+	t.Run("pre-authenticated-other-bucket", func(t *testing.T) {
+		os.Setenv("OCI_REGION", "us-ashburn-1")
+		for _, par := range []string{
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/fnproject/b/other/o/",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/n/other/b/cloudevents/o/",
+			"https://objectstorage.us-ashburn-1.oraclecloud.com/p/s3cr3t/",
+		} {
+			os.Setenv("OCI_PAR_URL", par)
+			_, err := GetMedia(loadCloudEvent(t, "payloads/oci.payload.json"))
+			var policy *URLPolicyError
+			if !errors.As(err, &policy) {
+				t.Fatalf("Error mismatch for '%s'!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", par, "a URL policy error", err)
+			}
+			if strings.Contains(err.Error(), "s3cr3t") {
+				t.Fatalf("error must not reveal the pre-authenticated request: %s", err.Error())
+			}
+		}
+	})
+
+	t.Run("no-region", func(t *testing.T) {
+		os.Setenv("OCI_REGION", "")
+		os.Setenv("OCI_PAR_URL", "")
+		_, err := GetMedia(loadCloudEvent(t, "payloads/oci.payload.json"))
+		if err == nil {
+			t.Fatal("expected an error when the region is unknown")
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/fnproject/fdk-go"
+	"github.com/google/uuid"
+)
+
+// MediaReceivedEventType is the type of the events
+// the receiver dispatches downstream.
+const MediaReceivedEventType = "io.fnproject.media.received"
+
+// MediaDeletedEventType is the type of the events the receiver
+// dispatches to the cleanup target for deleted media.
+const MediaDeletedEventType = "io.fnproject.media.deleted"
+
+const (
+	binaryMode     = "binary"
+	structuredMode = "structured"
+
+	structuredContentType = "application/cloudevents+json"
+)
+
+// extensionName is what CloudEvents 1.0 allows as the name of an attribute.
+var extensionName = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// reservedAttributes are the attributes CloudEvents 1.0 defines,
+// extensions must not shadow them.
+var reservedAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "time": true,
+	"subject": true, "dataschema": true, "datacontenttype": true, "data": true, "data_base64": true,
+}
+
+// extensionValue returns an extension value as a string, the way binary mode
+// carries it. Values CloudEvents has no type for, such as objects, are refused.
+func extensionValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	return "", false
+}
+
+// validExtension tells whether an extension can be carried over to an outbound event.
+func validExtension(name string, v interface{}) bool {
+	if reservedAttributes[name] || !extensionName.MatchString(name) {
+		return false
+	}
+	_, ok := extensionValue(v)
+	return ok
+}
+
+// NewMediaReceivedEvent builds the event dispatched for the media of ce.
+// The subject and extensions of ce are carried over, its id, source, type
+// and time are kept as the relatedid, originsource, origintype and
+// origintime extensions, so consumers can trace the event back. Extensions
+// that are no valid CloudEvents 1.0 attributes or that shadow one are dropped.
+func NewMediaReceivedEvent(ctx context.Context, ce *CloudEvent, media []Media) *CloudEvent {
+	return newMediaEvent(ctx, MediaReceivedEventType, ce, media)
+}
+
+// NewMediaDeletedEvent builds the event dispatched for the deleted media of ce,
+// the same way NewMediaReceivedEvent does.
+func NewMediaDeletedEvent(ctx context.Context, ce *CloudEvent, media []Media) *CloudEvent {
+	return newMediaEvent(ctx, MediaDeletedEventType, ce, media)
+}
+
+func newMediaEvent(ctx context.Context, eventType string, ce *CloudEvent, media []Media) *CloudEvent {
+	extensions := map[string]interface{}{}
+	for name, v := range ce.Extensions {
+		if !validExtension(name, v) {
+			log.Printf("dropping extension '%s' of event '%s', it is no valid CloudEvents attribute\n", name, ce.EventID)
+			continue
+		}
+		extensions[name] = v
+	}
+	extensions["relatedid"] = ce.EventID
+	extensions["originsource"] = ce.Source
+	extensions["origintype"] = ce.EventType
+	if !ce.EventTime.IsZero() {
+		extensions["origintime"] = ce.EventTime.Format(time.RFC3339Nano)
+	}
+
+	return &CloudEvent{
+		CloudEventsVersion: "1.0",
+		EventID:            uuid.New().String(),
+		Source:             withDefault("DISPATCH_SOURCE", dispatchSource(ctx)),
+		EventType:          eventType,
+		EventTime:          time.Now().UTC(),
+		ContentType:        "application/json",
+		Subject:            ce.Subject,
+		Extensions:         extensions,
+		Data:               newMediaProcessor(ce, media),
+	}
+}
+
+// newMediaProcessor is the data of the events dispatched for the media of ce.
+func newMediaProcessor(ce *CloudEvent, media []Media) MediaProcessor {
+	mp := MediaProcessor{
+		EventType: ce.EventType,
+		EventID:   ce.EventID,
+	}
+	for _, m := range media {
+		mp.MediaURL = append(mp.MediaURL, m.URL)
+		if m.Overwrite {
+			mp.Overwrites = append(mp.Overwrites, m.URL)
+		}
+		if m.OutOfOrder {
+			mp.OutOfOrder = append(mp.OutOfOrder, m.URL)
+		}
+		if m.Probe != nil {
+			mp.Probes = append(mp.Probes, *m.Probe)
+		}
+	}
+	return mp
+}
+
+// dispatchSource is the URL the receiver was invoked through, without the
+// query, which may carry credentials such as access_token.
+func dispatchSource(ctx context.Context) string {
+	return withoutQuery(fdk.Context(ctx).RequestURL)
+}
+
+// EncodeCloudEvent prepares ce for an HTTP request in the given content mode.
+// Extensions that are no valid attributes are left out, they would
+// otherwise overwrite the core attributes in binary mode.
+func EncodeCloudEvent(ce *CloudEvent, mode string) ([]byte, http.Header, error) {
+	if ce.Source == "" {
+		return nil, nil, fmt.Errorf("CloudEvent '%s' has no source, set DISPATCH_SOURCE", ce.EventID)
+	}
+	var buf bytes.Buffer
+	hs := http.Header{}
+
+	switch mode {
+	case structuredMode:
+		hs.Set("Content-Type", structuredContentType)
+		if err := json.NewEncoder(&buf).Encode(ce); err != nil {
+			return nil, nil, err
+		}
+	case binaryMode:
+		hs.Set("Content-Type", ce.ContentType)
+		hs.Set(binaryHeaderPrefix+"specversion", "1.0")
+		hs.Set(binaryHeaderPrefix+"id", ce.EventID)
+		hs.Set(binaryHeaderPrefix+"source", ce.Source)
+		hs.Set(binaryHeaderPrefix+"type", ce.EventType)
+		if !ce.EventTime.IsZero() {
+			hs.Set(binaryHeaderPrefix+"time", ce.EventTime.Format(time.RFC3339Nano))
+		}
+		if ce.Subject != "" {
+			hs.Set(binaryHeaderPrefix+"subject", url.PathEscape(ce.Subject))
+		}
+		if ce.SchemaURL != "" {
+			hs.Set(binaryHeaderPrefix+"dataschema", ce.SchemaURL)
+		}
+		for name, v := range ce.Extensions {
+			if !validExtension(name, v) {
+				continue
+			}
+			s, _ := extensionValue(v)
+			hs.Set(binaryHeaderPrefix+name, url.PathEscape(s))
+		}
+		if b, ok := ce.Data.([]byte); ok {
+			buf.Write(b)
+		} else if err := json.NewEncoder(&buf).Encode(ce.Data); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown DISPATCH_MODE '%s', expected '%s' or '%s'",
+			mode, binaryMode, structuredMode)
+	}
+
+	return buf.Bytes(), hs, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fnproject/fdk-go"
+)
+
+func TestNewMediaReceivedEventExtensions(t *testing.T) {
+	ce := &CloudEvent{
+		CloudEventsVersion: "0.1",
+		EventID:            "C234-1234-1234",
+		Source:             "https://serverless.com",
+		EventType:          "aws.s3.object.created",
+		Extensions: map[string]interface{}{
+			"id":          "forged",
+			"type":        "forged",
+			"specversion": "0.2",
+			"source":      "https://evil.example",
+			"awsregion":   "us-east-1",
+			"retries":     float64(2),
+			"comExample":  "camel case",
+			"nested":      map[string]interface{}{"a": "b"},
+		},
+	}
+	outCE := NewMediaReceivedEvent(testContext(nil), ce, []Media{{URL: "https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"}})
+
+	_, hs, err := EncodeCloudEvent(outCE, binaryMode)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := http.Header{
+		"Content-Type":    {"application/json"},
+		"Ce-Specversion":  {"1.0"},
+		"Ce-Id":           {outCE.EventID},
+		"Ce-Source":       {"http://localhost:8080/t/cloudevents/receiver"},
+		"Ce-Type":         {MediaReceivedEventType},
+		"Ce-Time":         {hs.Get("Ce-Time")},
+		"Ce-Awsregion":    {"us-east-1"},
+		"Ce-Retries":      {"2"},
+		"Ce-Relatedid":    {"C234-1234-1234"},
+		"Ce-Originsource": {"https:%2F%2Fserverless.com"},
+		"Ce-Origintype":   {"aws.s3.object.created"},
+	}
+	if !reflect.DeepEqual(hs, expected) {
+		t.Fatalf("Header mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, hs)
+	}
+}
+
+func TestEncodeCloudEventWithoutSource(t *testing.T) {
+	for _, mode := range []string{binaryMode, structuredMode} {
+		_, _, err := EncodeCloudEvent(&CloudEvent{EventID: "1", EventType: MediaReceivedEventType}, mode)
+		if err == nil {
+			t.Fatalf("Expected an event without source to be refused in %s mode", mode)
+		}
+	}
+}
+
+func TestNewMediaReceivedEventSourceWithoutQuery(t *testing.T) {
+	ctx := fdk.WithContext(context.Background(), &fdk.Ctx{
+		Header:     http.Header{},
+		RequestURL: "http://localhost:8080/t/cloudevents/receiver?access_token=s3cr3t",
+		Method:     http.MethodPost,
+	})
+	ce := &CloudEvent{EventID: "1", Source: "https://serverless.com", EventType: "aws.s3.object.created"}
+	outCE := NewMediaReceivedEvent(ctx, ce, []Media{{URL: "https://s3.amazonaws.com/cloudevents/dan_kohn.jpg"}})
+
+	expected := "http://localhost:8080/t/cloudevents/receiver"
+	if outCE.Source != expected {
+		t.Fatalf("Source mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, outCE.Source)
+	}
+	_, hs, err := EncodeCloudEvent(outCE, binaryMode)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Contains(hs.Get("Ce-Source"), "s3cr3t") {
+		t.Fatalf("Expected the access token to be left out, got: %v", hs.Get("Ce-Source"))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	probeHead  = "head"
+	probeRange = "range"
+)
+
+// ProbeError is returned for media a probe could not fetch. Temporary
+// failures, such as 5xx responses and timeouts, may go away on a retry.
+type ProbeError struct {
+	URL        string
+	StatusCode int
+	Reason     string
+	Temporary  bool
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("probe of media URL '%s' failed: %s", e.URL, e.Reason)
+}
+
+// MediaProbe is what a probe found out about media: the content type
+// sniffed from its first bytes or reported by its store, its length and ETag.
+type MediaProbe struct {
+	URL           string `json:"url"`
+	ContentType   string `json:"content_type,omitempty"`
+	ContentLength int64  `json:"content_length,omitempty"`
+	ETag          string `json:"etag,omitempty"`
+}
+
+// Prober checks media before it is dispatched, so processors are not spun up
+// for media that is gone or no image. In the range mode the first bytes of the
+// media are fetched to sniff its type, the head mode relies on what the store
+// reports. Pre-signed S3 URLs are only valid for GET, so they need the range mode.
+type Prober struct {
+	Mode    string
+	Bytes   int64
+	Timeout time.Duration
+	Policy  URLPolicy
+}
+
+// proberFromConfig returns the prober MEDIA_PROBE enables, nil without one.
+func proberFromConfig() *Prober {
+	mode := os.Getenv("MEDIA_PROBE")
+	if mode == "" {
+		return nil
+	}
+	if mode != probeHead && mode != probeRange {
+		log.Printf("unknown MEDIA_PROBE '%s', falling back to '%s'\n", mode, probeRange)
+		mode = probeRange
+	}
+	return &Prober{
+		Mode:    mode,
+		Bytes:   sizeWithDefault("MEDIA_PROBE_BYTES", 512),
+		Timeout: durationWithDefault("MEDIA_PROBE_TIMEOUT", 5*time.Second),
+		Policy:  urlPolicyFromConfig(),
+	}
+}
+
+// client follows redirects only to URLs that pass the URL policy.
+func (p *Prober) client(ctx context.Context, ce *CloudEvent) *http.Client {
+	return &http.Client{
+		Timeout: p.Timeout,
+		CheckRedirect: checkRedirect(func(rawURL string) string {
+			return p.Policy.check(ctx, ce, rawURL)
+		}),
+	}
+}
+
+// probe fetches what it takes to learn about media. The media is fetched
+// through its signed URL, but failures refer to it by its reference.
+func (p *Prober) probe(ctx context.Context, client *http.Client, m *Media) (*MediaProbe, *ProbeError) {
+	ref := m.reference()
+	method := http.MethodGet
+	if p.Mode == probeHead {
+		method = http.MethodHead
+	}
+	signed, err := m.signedURL()
+	if err != nil {
+		return nil, &ProbeError{URL: ref, Reason: err.Error()}
+	}
+	req, err := http.NewRequest(method, signed, nil)
+	if err != nil {
+		return nil, &ProbeError{URL: ref, Reason: "invalid URL"}
+	}
+	if p.Mode == probeRange {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", p.Bytes-1))
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		// redirects to unsafe URLs do not go away, connection failures may
+		var perr *URLPolicyError
+		reason := err.Error()
+		// the URL of the request is the signed one, leave it out
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			reason = uerr.Err.Error()
+		}
+		return nil, &ProbeError{URL: ref, Reason: reason, Temporary: !errors.As(err, &perr)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, &ProbeError{
+			URL:        ref,
+			StatusCode: resp.StatusCode,
+			Reason:     "status " + strconv.Itoa(resp.StatusCode),
+			Temporary:  resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
+	}
+
+	result := &MediaProbe{
+		URL:           m.URL,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+		ETag:          strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+	// a ranged response tells the length of the whole media in its Content-Range
+	if resp.StatusCode == http.StatusPartialContent {
+		result.ContentLength = -1
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				result.ContentLength = n
+			}
+		}
+	}
+	if result.ContentLength < 0 {
+		result.ContentLength = 0
+	}
+
+	if p.Mode == probeRange {
+		head, err := ioutil.ReadAll(io.LimitReader(resp.Body, p.Bytes))
+		if err != nil {
+			return nil, &ProbeError{URL: ref, Reason: err.Error(), Temporary: true}
+		}
+		// the sniffer knows the magic bytes of the common image and video
+		// formats, text formats such as SVG are left to what the store reports
+		sniffed := http.DetectContentType(head)
+		if sniffed != "application/octet-stream" &&
+			(result.ContentType == "" || !strings.HasPrefix(sniffed, "text/")) {
+			result.ContentType = sniffed
+		}
+	}
+	if t, _, err := mime.ParseMediaType(result.ContentType); err == nil {
+		result.ContentType = t
+	}
+	return result, nil
+}
+
+// Apply probes the media of an event. Media that passes gets the probed
+// content type and size, which the filters and routes work with from then
+// on, media that fails is returned as such.
+func (p *Prober) Apply(ctx context.Context, ce *CloudEvent, media []Media) (reachable []Media, failed []*ProbeError) {
+	if p == nil {
+		return media, nil
+	}
+	client := p.client(ctx, ce)
+	for _, m := range media {
+		result, err := p.probe(ctx, client, &m)
+		if err != nil {
+			log.Println(err.Error())
+			failed = append(failed, err)
+			continue
+		}
+		if result.ContentType != "" {
+			m.ContentType = result.ContentType
+		}
+		if result.ContentLength > 0 {
+			m.Size = result.ContentLength
+		}
+		m.Probe = result
+		reachable = append(reachable, m)
+	}
+	return reachable, failed
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pngImage starts with the magic bytes of a PNG.
+var pngImage = append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 1024)...)
+
+// mediaServer serves a PNG as an octet stream, the way stores do
+// when uploads do not say what they are.
+func mediaServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/missing.png"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/busy.png"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case strings.HasSuffix(r.URL.Path, "/moved.png"):
+			http.Redirect(w, r, strings.Replace(r.URL.String(), "moved", "a", 1), http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("ETag", `"38b01ff16138d7ca0a0eb3f7a88ff815"`)
+			http.ServeContent(w, r, "a.png", time.Time{}, bytes.NewReader(pngImage))
+		}
+	}))
+}
+
+func TestProber(t *testing.T) {
+	srv := mediaServer()
+	defer srv.Close()
+	policy := URLPolicy{Schemes: []string{"http"}, AllowPrivate: true}
+
+	testSuites := []struct {
+		name      string
+		mode      string
+		path      string
+		expected  *MediaProbe
+		temporary bool
+	}{
+		{"range", probeRange, "/a.png", &MediaProbe{
+			ContentType: "image/png", ContentLength: int64(len(pngImage)), ETag: "38b01ff16138d7ca0a0eb3f7a88ff815"}, false},
+		{"head", probeHead, "/a.png", &MediaProbe{
+			ContentType: "application/octet-stream", ContentLength: int64(len(pngImage)), ETag: "38b01ff16138d7ca0a0eb3f7a88ff815"}, false},
+		{"redirect", probeRange, "/moved.png", &MediaProbe{
+			ContentType: "image/png", ContentLength: int64(len(pngImage)), ETag: "38b01ff16138d7ca0a0eb3f7a88ff815"}, false},
+		{"missing", probeRange, "/missing.png", nil, false},
+		{"busy", probeHead, "/busy.png", nil, true},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			p := &Prober{Mode: ts.mode, Bytes: 512, Timeout: time.Second, Policy: policy}
+			media, failed := p.Apply(context.Background(), &CloudEvent{}, []Media{{URL: srv.URL + ts.path}})
+			if ts.expected == nil {
+				if len(failed) != 1 || failed[0].Temporary != ts.temporary {
+					t.Fatalf("Expected a probe failure, got: %v", failed)
+				}
+				return
+			}
+			if len(media) != 1 {
+				t.Fatalf("Unexpected probe failure: %v", failed[0])
+			}
+			ts.expected.URL = srv.URL + ts.path
+			if !reflect.DeepEqual(media[0].Probe, ts.expected) {
+				t.Fatalf("Probe mismatch!"+
+					"\n\tExpected: %+v"+
+					"\n\tActual: %+v", ts.expected, media[0].Probe)
+			}
+			if media[0].ContentType != ts.expected.ContentType || media[0].Size != ts.expected.ContentLength {
+				t.Fatalf("Expected the probe results to be taken over, got: %+v", media[0])
+			}
+		})
+	}
+
+	t.Run("unsafe-redirect", func(t *testing.T) {
+		p := &Prober{Mode: probeRange, Bytes: 512, Timeout: time.Second,
+			Policy: URLPolicy{Schemes: []string{"https"}, AllowPrivate: true}}
+		_, failed := p.Apply(context.Background(), &CloudEvent{}, []Media{{URL: srv.URL + "/moved.png"}})
+		if len(failed) != 1 || failed[0].Temporary || !strings.Contains(failed[0].Reason, "scheme 'http' is not allowed") {
+			t.Fatalf("Expected the redirect to be refused, got: %v", failed)
+		}
+	})
+}
+
+func TestMyHandlerProbe(t *testing.T) {
+	srv := mediaServer()
+	defer srv.Close()
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	for k, v := range map[string]string{
+		"MEDIA_PROBE":             probeRange,
+		"S3_ENDPOINT":             srv.URL,
+		"MEDIA_URL_SCHEMES":       "http",
+		"MEDIA_URL_ALLOW_PRIVATE": "true",
+		"MEDIA_ALLOW_TYPES":       "image/*",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	payload := `{"specversion": "1.0", "type": "aws.s3.object.created", "id": "1", "source": "s",
+		"data": {"bucket": {"name": "cloudevents"}, "object": {"key": "%s"}}}`
+	_, err := myHandler(testContext(nil), strings.NewReader(strings.Replace(payload, "%s", "a.png", 1)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(d.bodies) != 1 || len(d.bodies[0].Probes) != 1 || d.bodies[0].Probes[0].ContentType != "image/png" {
+		t.Fatalf("Expected the probe results to be dispatched, got: %+v", d.bodies)
+	}
+
+	_, err = myHandler(testContext(nil), strings.NewReader(strings.Replace(payload, "%s", "missing.png", 1)))
+	if p := NewProblem(err); p.Status != http.StatusUnprocessableEntity || p.Type != problemTypePrefix+"unreachable-media" {
+		t.Fatalf("Expected an unreachable-media problem, got: %v", err)
+	}
+	if len(d.bodies) != 1 {
+		t.Fatalf("Unreachable media must not be dispatched, got: %v", d.bodies)
+	}
+}
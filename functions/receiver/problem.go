@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:fnproject:receiver:"
+)
+
+// Problem is the RFC 7807 problem document failures are answered with.
+// Its type tells failures apart, the event ID names the event that failed.
+type Problem struct {
+	Type    string       `json:"type"`
+	Title   string       `json:"title"`
+	Status  int          `json:"status"`
+	Detail  string       `json:"detail,omitempty"`
+	EventID string       `json:"event_id,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty"`
+
+	retryAfter time.Duration
+}
+
+// MalformedEventError is returned for requests that are not events
+// in any of the accepted formats.
+type MalformedEventError struct {
+	Err error
+}
+
+func (e *MalformedEventError) Error() string {
+	return "malformed event: " + e.Err.Error()
+}
+
+func (e *MalformedEventError) Unwrap() error {
+	return e.Err
+}
+
+// EventError ties a failure to the event it occurred for.
+type EventError struct {
+	EventID string
+	Err     error
+}
+
+func (e *EventError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EventError) Unwrap() error {
+	return e.Err
+}
+
+func newProblem(slug, title string, status int, err error) *Problem {
+	return &Problem{Type: problemTypePrefix + slug, Title: title, Status: status, Detail: err.Error()}
+}
+
+// NewProblem turns an error of the handler into a problem document:
+//
+//   - 400 for malformed events and event data
+//   - 401 and 403 for unauthenticated callers
+//   - 410 and 425 for events outside the freshness window
+//   - 422 for unsupported events (or 204, see UNSUPPORTED_EVENT_STATUS),
+//     unsafe or unreachable media URLs and data that does not match its schema
+//   - 502 for targets failing to accept an event, 503 for targets or media
+//     that are unavailable or unreachable, 504 when they time out
+//   - 500 for anything else
+func NewProblem(err error) *Problem {
+	p := classify(err)
+	var eerr *EventError
+	if errors.As(err, &eerr) {
+		p.EventID = eerr.EventID
+	}
+	return p
+}
+
+func classify(err error) *Problem {
+	var (
+		malformed   *MalformedEventError
+		syntax      *json.SyntaxError
+		unmarshal   *json.UnmarshalTypeError
+		auth        *AuthError
+		unsupported *UnsupportedEventError
+		unsafeURL   *URLPolicyError
+		invalid     *SchemaValidationError
+		unmappable  *MappingError
+		eventTime   *EventTimeError
+		probe       *ProbeError
+		dispatch    *DispatchError
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &malformed), errors.As(err, &syntax), errors.As(err, &unmarshal):
+		return newProblem("malformed-event", "Malformed event", http.StatusBadRequest, err)
+	case errors.As(err, &auth):
+		if auth.StatusCode == http.StatusUnauthorized {
+			return newProblem("unauthenticated", "Unauthenticated", auth.StatusCode, err)
+		}
+		return newProblem("forbidden", "Forbidden", auth.StatusCode, err)
+	case errors.As(err, &unsupported):
+		status := http.StatusUnprocessableEntity
+		if withDefault("UNSUPPORTED_EVENT_STATUS", "422") == strconv.Itoa(http.StatusNoContent) {
+			status = http.StatusNoContent
+		}
+		return newProblem("unsupported-event", "Unsupported event", status, err)
+	case errors.As(err, &unsafeURL):
+		return newProblem("unsafe-url", "Unsafe URL", http.StatusUnprocessableEntity, err)
+	case errors.As(err, &probe):
+		if probe.Temporary {
+			return newProblem("media-unavailable", "Media unavailable", http.StatusServiceUnavailable, err)
+		}
+		return newProblem("unreachable-media", "Unreachable media", http.StatusUnprocessableEntity, err)
+	case errors.As(err, &invalid):
+		p := newProblem("invalid-data", "Invalid event data", http.StatusUnprocessableEntity, err)
+		p.EventID = invalid.EventID
+		p.Errors = invalid.Errors
+		return p
+	case errors.As(err, &unmappable):
+		p := newProblem("unmappable-data", "Unmappable event data", http.StatusUnprocessableEntity, err)
+		p.EventID = unmappable.EventID
+		return p
+	case errors.As(err, &eventTime):
+		p := newProblem("early-event", "Event from the future", eventTime.statusCode(), err)
+		if eventTime.Stale {
+			p = newProblem("stale-event", "Stale event", eventTime.statusCode(), err)
+		}
+		p.EventID = eventTime.EventID
+		return p
+	case errors.As(err, &dispatch):
+		// the response of the target stays in the logs, producers
+		// only learn about its status
+		log.Println(dispatch.Error())
+		detail := fmt.Errorf("dispatch failed with status %d", dispatch.StatusCode)
+		switch {
+		case dispatch.StatusCode == http.StatusTooManyRequests, dispatch.StatusCode == http.StatusServiceUnavailable:
+			p := newProblem("downstream-unavailable", "Downstream unavailable", http.StatusServiceUnavailable, detail)
+			p.retryAfter = dispatch.RetryAfter
+			return p
+		case dispatch.StatusCode == http.StatusRequestTimeout, dispatch.StatusCode == http.StatusGatewayTimeout:
+			return newProblem("downstream-timeout", "Downstream timeout", http.StatusGatewayTimeout, detail)
+		}
+		return newProblem("downstream-failure", "Downstream failure", http.StatusBadGateway, detail)
+	case errors.Is(err, context.DeadlineExceeded):
+		return newProblem("downstream-timeout", "Downstream timeout", http.StatusGatewayTimeout, err)
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return newProblem("downstream-timeout", "Downstream timeout", http.StatusGatewayTimeout, err)
+		}
+		return newProblem("downstream-unavailable", "Downstream unavailable", http.StatusServiceUnavailable, err)
+	}
+	return newProblem("internal", "Internal error", http.StatusInternalServerError, err)
+}
+
+// Header returns the headers the problem goes along with.
+func (p *Problem) Header() http.Header {
+	hs := http.Header{"Content-Type": {problemContentType}}
+	if p.Status == http.StatusUnauthorized {
+		hs.Set("WWW-Authenticate", "Bearer")
+	}
+	if p.retryAfter > 0 {
+		hs.Set("Retry-After", strconv.Itoa(int(math.Ceil(p.retryAfter.Seconds()))))
+	}
+	return hs
+}
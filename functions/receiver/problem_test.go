@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusCode is the HTTP status an error of the handler is answered with.
+func statusCode(err error) int {
+	return NewProblem(err).Status
+}
+
+func TestNewProblem(t *testing.T) {
+	testSuites := []struct {
+		name    string
+		err     error
+		typ     string
+		status  int
+		eventID string
+		detail  string
+	}{
+		{"malformed", &MalformedEventError{Err: errors.New("unexpected EOF")}, "malformed-event", http.StatusBadRequest, "", ""},
+		{"syntax", &json.SyntaxError{}, "malformed-event", http.StatusBadRequest, "", ""},
+		{"unauthenticated", &AuthError{StatusCode: http.StatusUnauthorized, Reason: "no credentials"}, "unauthenticated", http.StatusUnauthorized, "", ""},
+		{"forbidden", &AuthError{StatusCode: http.StatusForbidden, Reason: "signature mismatch"}, "forbidden", http.StatusForbidden, "", ""},
+		{"unsupported", &EventError{EventID: "1", Err: &UnsupportedEventError{}}, "unsupported-event", http.StatusUnprocessableEntity, "1", ""},
+		{"unsafe-url", &EventError{EventID: "2", Err: &URLPolicyError{URL: "http://10.0.0.1/", Reason: "private"}}, "unsafe-url", http.StatusUnprocessableEntity, "2", ""},
+		{"invalid-data", &SchemaValidationError{EventID: "3", Schema: "s"}, "invalid-data", http.StatusUnprocessableEntity, "3", ""},
+		{"unmappable-data", &MappingError{EventID: "7", Mapping: "m", Reason: "no media found"}, "unmappable-data", http.StatusUnprocessableEntity, "7", ""},
+		{"stale", &EventTimeError{EventID: "4", Stale: true}, "stale-event", http.StatusGone, "4", ""},
+		{"early", &EventTimeError{EventID: "5"}, "early-event", http.StatusTooEarly, "5", ""},
+		{"throttled", &EventError{EventID: "6", Err: &DispatchError{StatusCode: http.StatusTooManyRequests, Body: "rate limit of tenant 42"}}, "downstream-unavailable", http.StatusServiceUnavailable, "6", "dispatch failed with status 429"},
+		{"downstream-timeout", &DispatchError{StatusCode: http.StatusGatewayTimeout}, "downstream-timeout", http.StatusGatewayTimeout, "", "dispatch failed with status 504"},
+		{"downstream-failure", &DispatchError{Target: "http://10.0.0.7:8080/invoke", StatusCode: http.StatusInternalServerError, Body: "panic: nil map"}, "downstream-failure", http.StatusBadGateway, "", "dispatch failed with status 500"},
+		{"deadline", context.DeadlineExceeded, "downstream-timeout", http.StatusGatewayTimeout, "", ""},
+		{"internal", errors.New("boom"), "internal", http.StatusInternalServerError, "", ""},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			p := NewProblem(ts.err)
+			if p.Type != problemTypePrefix+ts.typ || p.Status != ts.status || p.EventID != ts.eventID {
+				t.Fatalf("Problem mismatch!"+
+					"\n\tExpected: %v %v %v"+
+					"\n\tActual: %v %v %v",
+					problemTypePrefix+ts.typ, ts.status, ts.eventID, p.Type, p.Status, p.EventID)
+			}
+			detail := ts.detail
+			if detail == "" {
+				detail = ts.err.Error()
+			}
+			if p.Detail != detail {
+				t.Fatalf("Detail mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", detail, p.Detail)
+			}
+		})
+	}
+}
+
+func TestProblemHeader(t *testing.T) {
+	p := NewProblem(&DispatchError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 1500 * time.Millisecond})
+	hs := p.Header()
+	if hs.Get("Content-Type") != problemContentType {
+		t.Fatalf("Unexpected content type: %v", hs.Get("Content-Type"))
+	}
+	if hs.Get("Retry-After") != "2" {
+		t.Fatalf("Unexpected Retry-After: %v", hs.Get("Retry-After"))
+	}
+
+	hs = NewProblem(&AuthError{StatusCode: http.StatusUnauthorized}).Header()
+	if hs.Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("Expected a challenge, got: %v", hs)
+	}
+}
+
+func TestUnsupportedEventStatus(t *testing.T) {
+	os.Setenv("UNSUPPORTED_EVENT_STATUS", "204")
+	defer os.Unsetenv("UNSUPPORTED_EVENT_STATUS")
+
+	if status := statusCode(&UnsupportedEventError{}); status != http.StatusNoContent {
+		t.Fatalf("Unexpected status code: %v", status)
+	}
+}
+
+func TestMyHandlerMalformedEvent(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	_, err := myHandler(testContext(nil), strings.NewReader(`{"specversion": "1.0", "id": `))
+	p := NewProblem(err)
+	if p.Status != http.StatusBadRequest || p.Type != problemTypePrefix+"malformed-event" {
+		t.Fatalf("Expected a malformed-event problem, got: %v", err)
+	}
+}
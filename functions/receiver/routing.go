@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultTarget is where media goes unless routing says otherwise.
+const defaultTarget = "/image-processor"
+
+// RouteMatch holds the conditions of a route, all of which must be met.
+// Type, source, subject and content type are patterns where '*' matches
+// any sequence of characters, extensions are compared case-insensitively.
+// Empty conditions match anything.
+type RouteMatch struct {
+	Type        string   `yaml:"type"`
+	Source      string   `yaml:"source"`
+	Subject     string   `yaml:"subject"`
+	ContentType string   `yaml:"contentType"`
+	Extensions  []string `yaml:"extensions"`
+}
+
+// Route sends the media it matches to one or more targets. A target is either
+// the path of a function of the receiver's app or an invoke URL.
+type Route struct {
+	Name    string     `yaml:"name"`
+	Match   RouteMatch `yaml:"match"`
+	Targets []string   `yaml:"targets"`
+}
+
+// RoutingTable maps media to dispatch targets. Routes are consulted in order,
+// the first match wins, media no route matches goes to the default targets.
+type RoutingTable struct {
+	Default []string `yaml:"default"`
+	Routes  []Route  `yaml:"routes"`
+}
+
+// Dispatch is the media of an event that goes to a single target.
+type Dispatch struct {
+	Target string
+	Media  []Media
+}
+
+func (m *RouteMatch) matchesEvent(ce *CloudEvent) bool {
+	return (m.Type == "" || globMatch(m.Type, ce.EventType)) &&
+		(m.Source == "" || globMatch(m.Source, ce.Source)) &&
+		(m.Subject == "" || globMatch(m.Subject, ce.Subject))
+}
+
+func (m *RouteMatch) matchesMedia(media *Media) bool {
+	if m.ContentType != "" && !globMatch(m.ContentType, media.ContentType) {
+		return false
+	}
+	if len(m.Extensions) == 0 {
+		return true
+	}
+	ext := mediaExtension(media)
+	for _, e := range m.Extensions {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaExtension is the file extension of the media URL, without the dot.
+func mediaExtension(media *Media) string {
+	p := media.URL
+	if u, err := url.Parse(media.URL); err == nil {
+		p = u.Path
+	}
+	return strings.TrimPrefix(path.Ext(p), ".")
+}
+
+// Plan groups the media of an event by the targets it is routed to,
+// keeping the order in which targets first show up.
+func (t *RoutingTable) Plan(ce *CloudEvent, media []Media) []Dispatch {
+	var plan []Dispatch
+	index := map[string]int{}
+	for _, m := range media {
+		targets := t.Default
+		for _, r := range t.Routes {
+			if r.Match.matchesEvent(ce) && r.Match.matchesMedia(&m) {
+				targets = r.Targets
+				break
+			}
+		}
+		for _, target := range targets {
+			i, ok := index[target]
+			if !ok {
+				i = len(plan)
+				index[target] = i
+				plan = append(plan, Dispatch{Target: target})
+			}
+			plan[i].Media = append(plan[i].Media, m)
+		}
+	}
+	return plan
+}
+
+// resolveTarget turns a function path into the URL to invoke it with,
+// invoke URLs are used as they are.
+func resolveTarget(ctx context.Context, target string) string {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return target
+	}
+	return fnTriggerURL(ctx, target)
+}
+
+// ParseRoutingTable reads a routing table in YAML, which JSON is a subset of.
+func ParseRoutingTable(b []byte) (*RoutingTable, error) {
+	var t RoutingTable
+	err := yaml.UnmarshalStrict(b, &t)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing table: %s", err.Error())
+	}
+	if len(t.Default) == 0 {
+		t.Default = []string{defaultTarget}
+	}
+	for i, r := range t.Routes {
+		if len(r.Targets) == 0 {
+			return nil, fmt.Errorf("invalid routing table: route %d (%s) has no targets", i, r.Name)
+		}
+	}
+	return &t, nil
+}
+
+var (
+	routingOnce  sync.Once
+	routingTable *RoutingTable
+	routingErr   error
+)
+
+// getRoutingTable loads the routing table from the ROUTES config or the file
+// ROUTES_FILE points at. Without either, all media goes to the image-processor.
+func getRoutingTable() (*RoutingTable, error) {
+	routingOnce.Do(func() {
+		routingTable, routingErr = loadRoutingTable()
+		if routingErr != nil {
+			log.Println("unable to load routing table: ", routingErr.Error())
+		}
+	})
+	return routingTable, routingErr
+}
+
+func loadRoutingTable() (*RoutingTable, error) {
+	if routes := os.Getenv("ROUTES"); routes != "" {
+		return ParseRoutingTable([]byte(routes))
+	}
+	if file := os.Getenv("ROUTES_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseRoutingTable(b)
+	}
+	return &RoutingTable{Default: []string{defaultTarget}}, nil
+}
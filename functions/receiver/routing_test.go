@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func loadExampleRoutingTable(t *testing.T) *RoutingTable {
+	b, err := ioutil.ReadFile("routes.example.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table, err := ParseRoutingTable(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return table
+}
+
+func TestRoutingTablePlan(t *testing.T) {
+	table := loadExampleRoutingTable(t)
+
+	s3 := &CloudEvent{EventType: "aws.s3.object.created", Source: "arn:aws:s3:::cloudevents"}
+	azure := &CloudEvent{
+		EventType: "Microsoft.Storage.BlobCreated",
+		Subject:   "/blobServices/default/containers/screenshots/blobs/a.png",
+	}
+	jpg := Media{URL: "https://s3.amazonaws.com/cloudevents/a.jpg"}
+	mp4 := Media{URL: "https://s3.amazonaws.com/cloudevents/b.MP4?versionId=1"}
+	pdf := Media{URL: "https://s3.amazonaws.com/cloudevents/c", ContentType: "application/pdf"}
+	png := Media{URL: "https://cvtest34.blob.core.windows.net/screenshots/a.png", ContentType: "image/png"}
+
+	testSuites := []struct {
+		name     string
+		ce       *CloudEvent
+		media    []Media
+		expected []Dispatch
+	}{
+		{"default", s3, []Media{jpg}, []Dispatch{
+			{Target: "/image-processor", Media: []Media{jpg}},
+		}},
+		{"split-by-extension", s3, []Media{jpg, mp4}, []Dispatch{
+			{Target: "/image-processor", Media: []Media{jpg}},
+			{Target: "/video-processor", Media: []Media{mp4}},
+		}},
+		{"fan-out", s3, []Media{pdf}, []Dispatch{
+			{Target: "/pdf-processor", Media: []Media{pdf}},
+			{Target: "https://archive.example.com/invoke/pdf", Media: []Media{pdf}},
+		}},
+		{"subject", azure, []Media{png}, []Dispatch{
+			{Target: "/screenshot-processor", Media: []Media{png}},
+		}},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			plan := table.Plan(ts.ce, ts.media)
+			if !reflect.DeepEqual(plan, ts.expected) {
+				t.Fatalf("Plan mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.expected, plan)
+			}
+		})
+	}
+}
+
+func TestParseRoutingTableInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown-field": `routes: [{match: {kind: video}, targets: [/video-processor]}]`,
+		"no-targets":    `routes: [{name: videos, match: {extensions: [mp4]}}]`,
+		"not-yaml":      `routes: [`,
+	} {
+		if _, err := ParseRoutingTable([]byte(config)); err == nil {
+			t.Fatalf("expected an error for %s routing table: %v", name, config)
+		}
+	}
+
+	table, err := ParseRoutingTable([]byte(`{"routes": []}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(table.Default, []string{defaultTarget}) {
+		t.Fatalf("Unexpected default targets: %v", table.Default)
+	}
+}
+
+func TestMyHandlerRouting(t *testing.T) {
+	table, err := ParseRoutingTable([]byte(`
+routes:
+  - name: png
+    match: {extensions: [png]}
+    targets: [/png-processor]
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	getRoutingTable()
+	routingTable = table
+	defer func() { routingTable = &RoutingTable{Default: []string{defaultTarget}} }()
+
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	in, err := os.Open("payloads/aws.notification.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer in.Close()
+
+	resp, err := myHandler(testContext(nil), in)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := map[string][]string{
+		"/t/cloudevents/image-processor": {"https://s3.us-west-2.amazonaws.com/cloudevents/dan_kohn.jpg"},
+		"/t/cloudevents/png-processor":   {"https://s3.us-west-2.amazonaws.com/cloudevents/team/fn%20project.png"},
+	}
+	dispatched := map[string][]string{}
+	for i, r := range d.requests {
+		dispatched[r.URL.Path] = d.bodies[i].MediaURL
+	}
+	if !reflect.DeepEqual(dispatched, expected) {
+		t.Fatalf("Dispatch mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, dispatched)
+	}
+	targets := resp.(*HandlerResponse).Events[0].Targets
+	if !reflect.DeepEqual(targets, []string{"/image-processor", "/png-processor"}) {
+		t.Fatalf("Unexpected targets in the response: %v", targets)
+	}
+}
@@ -4,12 +4,24 @@ import (
 	"encoding/json"
 )
 
+func init() {
+	RegisterAdapter("Microsoft.Storage.BlobCreated", "", MediaAdapterFunc(ParseAzureData))
+	RegisterAdapter("Microsoft.Storage.BlobDeleted", "", MediaAdapterFunc(ParseAzureData))
+	RegisterMediaHosts("Microsoft.Storage.BlobCreated", func() []string {
+		return []string{"*.blob.core.windows.net", "*.dfs.core.windows.net"}
+	})
+}
+
 type AzureData struct {
-	URL string `json:"url"`
+	URL           string `json:"url"`
+	ContentType   string `json:"contentType"`
+	ContentLength int64  `json:"contentLength"`
+	ETag          string `json:"eTag"`
+	Sequencer     string `json:"sequencer"`
 }
 
-func ParseAzureData(ceData interface{}) (*string, error) {
-	b, err := json.Marshal(ceData)
+func ParseAzureData(ce *CloudEvent) ([]Media, error) {
+	b, err := json.Marshal(ce.Data)
 	if err != nil {
 		return nil, err
 	}
@@ -20,5 +32,20 @@ func ParseAzureData(ceData interface{}) (*string, error) {
 		return nil, err
 	}
 
-	return &d.URL, nil
+	m := Media{
+		URL:         d.URL,
+		ContentType: d.ContentType,
+		Size:        d.ContentLength,
+		Object:      withoutQuery(d.URL),
+		ETag:        d.ETag,
+		Sequencer:   d.Sequencer,
+		Deleted:     ce.EventType == "Microsoft.Storage.BlobDeleted",
+	}
+	if !m.Deleted {
+		m.signer, err = azureSignerFromConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []Media{m}, nil
 }
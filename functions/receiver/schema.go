@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xeipuuv/gojsonreference"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// builtinSchemas are the schemas of the event data the adapters understand,
+// named after the event type. They are part of the binary, as the function
+// image holds nothing else.
+//
+//go:embed schemas/*.json
+var builtinSchemas embed.FS
+
+// FieldError is a single violation of a schema.
+type FieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// SchemaValidationError is returned for an event whose data does not match its schema.
+type SchemaValidationError struct {
+	EventID string
+	Schema  string
+	Errors  []FieldError
+}
+
+func (e *SchemaValidationError) Error() string {
+	var fields []string
+	for _, f := range e.Errors {
+		fields = append(fields, f.Field+": "+f.Description)
+	}
+	return fmt.Sprintf("data of event '%s' does not match schema '%s': %s",
+		e.EventID, e.Schema, strings.Join(fields, "; "))
+}
+
+var (
+	schemasMu sync.Mutex
+	schemas   = map[string]*gojsonschema.Schema{}
+)
+
+// compileSchema compiles a schema once and keeps it under the given name.
+func compileSchema(name string, load func() (gojsonschema.JSONLoader, error)) (*gojsonschema.Schema, error) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	if s, ok := schemas[name]; ok {
+		return s, nil
+	}
+	l, err := load()
+	if err != nil || l == nil {
+		return nil, err
+	}
+	s, err := gojsonschema.NewSchema(l)
+	if err != nil {
+		var perr *URLPolicyError
+		if errors.As(err, &perr) {
+			return nil, perr
+		}
+		return nil, fmt.Errorf("invalid schema '%s': %s", name, err.Error())
+	}
+	schemas[name] = s
+	return s, nil
+}
+
+// localSchema reads the schema of an event type from SCHEMA_DIR,
+// falling back to the built-in ones. Without either there is none.
+func localSchema(eventType string) (gojsonschema.JSONLoader, error) {
+	if strings.ContainsAny(eventType, `/\`) {
+		return nil, nil
+	}
+	name := eventType + ".json"
+	if dir := os.Getenv("SCHEMA_DIR"); dir != "" {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return gojsonschema.NewBytesLoader(b), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	b, err := builtinSchemas.ReadFile("schemas/" + name)
+	if err != nil {
+		return nil, nil
+	}
+	return gojsonschema.NewBytesLoader(b), nil
+}
+
+// remoteSchemaLoader loads a remote schema and every schema its "$ref"s point
+// at through fetch. gojsonschema would otherwise load references on its own,
+// fetching any URL and reading local files. Every schema is fetched once.
+type remoteSchemaLoader struct {
+	fetch   func(rawURL string) ([]byte, error)
+	source  string
+	fetched map[string][]byte
+}
+
+func (l *remoteSchemaLoader) JsonSource() interface{} {
+	return l.source
+}
+
+func (l *remoteSchemaLoader) LoadJSON() (interface{}, error) {
+	body, ok := l.fetched[l.source]
+	if !ok {
+		var err error
+		if body, err = l.fetch(l.source); err != nil {
+			return nil, err
+		}
+		l.fetched[l.source] = body
+	}
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("schema '%s' is not JSON: %s", l.source, err.Error())
+	}
+	return doc, nil
+}
+
+func (l *remoteSchemaLoader) JsonReference() (gojsonreference.JsonReference, error) {
+	return gojsonreference.NewJsonReference(l.source)
+}
+
+func (l *remoteSchemaLoader) LoaderFactory() gojsonschema.JSONLoaderFactory {
+	return l
+}
+
+// New loads a referenced schema, the fragment is resolved by gojsonschema.
+func (l *remoteSchemaLoader) New(source string) gojsonschema.JSONLoader {
+	if i := strings.Index(source, "#"); i >= 0 {
+		source = source[:i]
+	}
+	return &remoteSchemaLoader{fetch: l.fetch, source: source, fetched: l.fetched}
+}
+
+// remoteSchema loads the schema an event references. The URL, any URL it
+// redirects to and the URLs of the schemas it references have to pass the
+// URL policy, restricted to SCHEMA_URL_HOSTS if set.
+func remoteSchema(ctx context.Context, schemaURL string) (gojsonschema.JSONLoader, error) {
+	policy := urlPolicyFromConfig()
+	hosts := listFromConfig("SCHEMA_URL_HOSTS")
+	fetch := func(rawURL string) ([]byte, error) {
+		return fetchSchema(ctx, policy, hosts, rawURL)
+	}
+	body, err := fetch(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSchemaLoader{fetch: fetch, source: schemaURL,
+		fetched: map[string][]byte{schemaURL: body}}, nil
+}
+
+// fetchSchema fetches a schema of at most SCHEMA_MAX_SIZE bytes.
+func fetchSchema(ctx context.Context, policy URLPolicy, hosts []string, schemaURL string) ([]byte, error) {
+	if reason := policy.checkURL(ctx, schemaURL, hosts); reason != "" {
+		return nil, &URLPolicyError{URL: schemaURL, Reason: reason}
+	}
+	client := &http.Client{
+		CheckRedirect: checkRedirect(func(rawURL string) string {
+			return policy.checkURL(ctx, rawURL, hosts)
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, durationWithDefault("SCHEMA_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, schemaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		var perr *URLPolicyError
+		if errors.As(err, &perr) {
+			return nil, perr
+		}
+		return nil, fmt.Errorf("unable to fetch schema '%s': %s", schemaURL, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch schema '%s': status %d", schemaURL, resp.StatusCode)
+	}
+	limit := sizeWithDefault("SCHEMA_MAX_SIZE", 1<<20)
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch schema '%s': %s", schemaURL, err.Error())
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("schema '%s' is larger than %d bytes", schemaURL, limit)
+	}
+	return b, nil
+}
+
+// schemaFor finds the schema of an event: the local one of its type or,
+// with SCHEMA_REMOTE enabled, the one its dataschema (schemaurl) references.
+// Compiled schemas are cached for as long as the function container lives.
+func schemaFor(ctx context.Context, ce *CloudEvent) (string, *gojsonschema.Schema, error) {
+	s, err := compileSchema("type:"+ce.EventType, func() (gojsonschema.JSONLoader, error) {
+		return localSchema(ce.EventType)
+	})
+	if s != nil || err != nil {
+		return ce.EventType, s, err
+	}
+	if ce.SchemaURL == "" || withDefault("SCHEMA_REMOTE", "false") != "true" {
+		return "", nil, nil
+	}
+	s, err = compileSchema("url:"+ce.SchemaURL, func() (gojsonschema.JSONLoader, error) {
+		return remoteSchema(ctx, ce.SchemaURL)
+	})
+	return ce.SchemaURL, s, err
+}
+
+// validateData checks the data of an event against its schema, if it has one.
+// Validation is on unless SCHEMA_VALIDATION is false.
+func validateData(ctx context.Context, ce *CloudEvent) error {
+	if withDefault("SCHEMA_VALIDATION", "true") == "false" {
+		return nil
+	}
+	name, schema, err := schemaFor(ctx, ce)
+	if err != nil || schema == nil {
+		return err
+	}
+
+	data := ce.Data
+	if b, ok := data.([]byte); ok {
+		if err := json.Unmarshal(b, &data); err != nil {
+			return &SchemaValidationError{EventID: ce.EventID, Schema: name,
+				Errors: []FieldError{{Field: "(root)", Description: "data is not JSON"}}}
+		}
+	}
+	result, err := schema.Validate(gojsonschema.NewGoLoader(data))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	verr := &SchemaValidationError{EventID: ce.EventID, Schema: name}
+	for _, e := range result.Errors() {
+		// the violations of the branches are reported on their own
+		if e.Type() == "condition_then" || e.Type() == "condition_else" {
+			continue
+		}
+		verr.Errors = append(verr.Errors, FieldError{Field: e.Field(), Description: e.Description()})
+	}
+	return verr
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDataPayloads(t *testing.T) {
+	for _, payload := range []string{
+		"payloads/aws.payload.json",
+		"payloads/aws.v1.0.payload.json",
+		"payloads/aws.records.payload.json",
+		"payloads/azure.payload.json",
+		"payloads/azure.v1.0.payload.json",
+		"payloads/gcs.payload.json",
+		"payloads/gcs.legacy.payload.json",
+	} {
+		t.Run(payload, func(t *testing.T) {
+			ce := loadCloudEvent(t, payload)
+			if err := validateData(context.Background(), ce); err != nil {
+				t.Fatal(err.Error())
+			}
+		})
+	}
+}
+
+func TestValidateDataInvalid(t *testing.T) {
+	testSuites := []struct {
+		name      string
+		eventType string
+		data      string
+		field     string
+	}{
+		{"s3-empty-bucket", "aws.s3.object.created",
+			`{"bucket": {"name": ""}, "object": {"key": "dan_kohn.jpg"}}`, "bucket.name"},
+		{"s3-no-key", "aws.s3.object.created",
+			`{"bucket": {"name": "cloudevents"}, "object": {}}`, "object"},
+		{"s3-record", "aws.s3.object.created",
+			`{"Records": [{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "cloudevents"}, "object": {"key": 1}}}]}`,
+			"Records.0.s3.object.key"},
+		{"azure-no-url", "Microsoft.Storage.BlobCreated", `{"contentType": "image/jpeg"}`, "(root)"},
+		{"azure-size", "Microsoft.Storage.BlobCreated",
+			`{"url": "https://cvtest34.blob.core.windows.net/a.jpg", "contentLength": -1}`, "contentLength"},
+		{"gcs-size", "google.cloud.storage.object.v1.finalized",
+			`{"bucket": "cloudevents", "name": "a.jpg", "size": "big"}`, "size"},
+		{"not-json", "google.storage.object.finalize", ``, "(root)"},
+	}
+
+	for _, ts := range testSuites {
+		t.Run(ts.name, func(t *testing.T) {
+			ce := &CloudEvent{EventID: "1", EventType: ts.eventType, Data: []byte(ts.data)}
+			err := validateData(context.Background(), ce)
+			verr, ok := err.(*SchemaValidationError)
+			if !ok {
+				t.Fatalf("Expected *SchemaValidationError, got: %v", err)
+			}
+			if verr.Errors[0].Field != ts.field {
+				t.Fatalf("Field mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.field, verr.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateDataSchemaDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "com.example.object.created.json"),
+		[]byte(`{"type": "object", "required": ["path"]}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Setenv("SCHEMA_DIR", dir)
+	defer os.Unsetenv("SCHEMA_DIR")
+
+	ce := &CloudEvent{EventID: "1", EventType: "com.example.object.created", Data: map[string]interface{}{}}
+	if _, ok := validateData(context.Background(), ce).(*SchemaValidationError); !ok {
+		t.Fatal("Expected the schema of SCHEMA_DIR to apply")
+	}
+}
+
+func TestValidateDataRemoteSchema(t *testing.T) {
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(`{"type": "object", "required": ["path"]}`))
+	}))
+	defer srv.Close()
+
+	ce := &CloudEvent{EventID: "1", EventType: "com.example.remote", SchemaURL: srv.URL + "/remote.json",
+		Data: map[string]interface{}{"path": "a.jpg"}}
+
+	if err := validateData(context.Background(), ce); err != nil {
+		t.Fatalf("Remote schemas must be opt-in, got: %v", err)
+	}
+
+	os.Setenv("SCHEMA_REMOTE", "true")
+	defer os.Unsetenv("SCHEMA_REMOTE")
+	if _, ok := validateData(context.Background(), ce).(*URLPolicyError); !ok {
+		t.Fatal("Expected schema URLs to pass the URL policy")
+	}
+
+	for k, v := range map[string]string{
+		"MEDIA_URL_SCHEMES":       "http",
+		"MEDIA_URL_ALLOW_PRIVATE": "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	for i := 0; i < 2; i++ {
+		if err := validateData(context.Background(), ce); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	ce.Data = map[string]interface{}{}
+	if _, ok := validateData(context.Background(), ce).(*SchemaValidationError); !ok {
+		t.Fatal("Expected the remote schema to apply")
+	}
+	if fetches != 1 {
+		t.Fatalf("Remote schemas must be cached, fetched %v times", fetches)
+	}
+
+	// redirects are held to the URL policy as well
+	os.Setenv("SCHEMA_URL_HOSTS", "127.0.0.1")
+	defer os.Unsetenv("SCHEMA_URL_HOSTS")
+	redirect := httptest.NewServer(http.RedirectHandler(
+		strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/remote.json", http.StatusFound))
+	defer redirect.Close()
+	ce.SchemaURL = redirect.URL + "/redirect.json"
+	if _, ok := validateData(context.Background(), ce).(*URLPolicyError); !ok {
+		t.Fatal("Expected the redirect to pass the URL policy")
+	}
+	if fetches != 1 {
+		t.Fatalf("Expected the redirect not to be followed, fetched %v times", fetches)
+	}
+}
+
+func TestValidateDataRemoteSchemaRefs(t *testing.T) {
+	secrets := 0
+	secret := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets++
+		w.Write([]byte(`{"type": "object"}`))
+	}))
+	defer secret.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/relative.json":
+			w.Write([]byte(`{"$ref": "defs.json#/definitions/media"}`))
+		case "/defs.json":
+			w.Write([]byte(`{"definitions": {"media": {"type": "object", "required": ["path"]}}}`))
+		case "/private.json":
+			w.Write([]byte(`{"$ref": "` + strings.Replace(secret.URL, "127.0.0.1", "localhost", 1) + `/secret#"}`))
+		case "/file.json":
+			w.Write([]byte(`{"$ref": "file:///etc/passwd#"}`))
+		case "/large.json":
+			w.Write([]byte(`{"type": "object", "description": "` + strings.Repeat("x", 2048) + `"}`))
+		}
+	}))
+	defer srv.Close()
+
+	for k, v := range map[string]string{
+		"SCHEMA_REMOTE":           "true",
+		"SCHEMA_URL_HOSTS":        "127.0.0.1",
+		"SCHEMA_MAX_SIZE":         "1KB",
+		"MEDIA_URL_SCHEMES":       "http",
+		"MEDIA_URL_ALLOW_PRIVATE": "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	ce := &CloudEvent{EventID: "1", EventType: "com.example.refs", SchemaURL: srv.URL + "/relative.json",
+		Data: map[string]interface{}{}}
+	if _, ok := validateData(context.Background(), ce).(*SchemaValidationError); !ok {
+		t.Fatal("Expected references of the allowed hosts to be followed")
+	}
+
+	for _, name := range []string{"private.json", "file.json"} {
+		ce.SchemaURL = srv.URL + "/" + name
+		if _, ok := validateData(context.Background(), ce).(*URLPolicyError); !ok {
+			t.Fatalf("Expected the references of %s to pass the URL policy", name)
+		}
+	}
+	if secrets != 0 {
+		t.Fatalf("Expected the refused reference not to be fetched, fetched %v times", secrets)
+	}
+
+	ce.SchemaURL = srv.URL + "/large.json"
+	if err := validateData(context.Background(), ce); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("Expected schemas larger than SCHEMA_MAX_SIZE to be refused, got: %v", err)
+	}
+}
+
+func TestMyHandlerRejectsInvalidData(t *testing.T) {
+	d := newDispatchRecorder(t)
+	defer d.Close()
+
+	payload := `{"specversion": "1.0", "type": "aws.s3.object.created", "id": "1", "source": "s",
+		"data": {"bucket": {"name": ""}, "object": {"key": "dan_kohn.jpg"}}}`
+	_, err := myHandler(testContext(nil), strings.NewReader(payload))
+	var verr *SchemaValidationError
+	if !errors.As(err, &verr) || statusCode(err) != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected a 422 *SchemaValidationError, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "bucket.name") {
+		t.Fatalf("Expected the field to be named, got: %v", err)
+	}
+	if len(d.bodies) != 0 {
+		t.Fatalf("Invalid events must not be dispatched, got: %v", d.bodies)
+	}
+}
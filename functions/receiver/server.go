@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fnproject/fdk-go"
+	"github.com/fnproject/fdk-go/utils"
+)
+
+// configFlag collects KEY=VALUE pairs, the config Fn would otherwise
+// pass to the function through its environment.
+type configFlag map[string]string
+
+func (c configFlag) String() string {
+	pairs := make([]string, 0, len(c))
+	for k, v := range c {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (c configFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("config '%s' is not KEY=VALUE", s)
+	}
+	c[kv[0]] = kv[1]
+	return nil
+}
+
+// ServerOptions configure the standalone HTTP server mode, which serves the
+// handler through net/http rather than fdk, so the receiver runs outside Fn.
+type ServerOptions struct {
+	Enabled bool
+	Port    string
+	Timeout time.Duration
+	Config  map[string]string
+}
+
+// parseServerOptions reads the command line. The server mode is enabled
+// with -http or RECEIVER_HTTP, the port defaults to PORT as set by
+// Knative and Cloud Run.
+func parseServerOptions(args []string) (*ServerOptions, error) {
+	opts := &ServerOptions{Config: map[string]string{}}
+	fs := flag.NewFlagSet("receiver", flag.ContinueOnError)
+	fs.BoolVar(&opts.Enabled, "http", withDefault("RECEIVER_HTTP", "false") == "true",
+		"serve HTTP on PORT rather than run as an Fn function")
+	fs.StringVar(&opts.Port, "port", withDefault("PORT", "8080"), "port to listen on")
+	fs.DurationVar(&opts.Timeout, "timeout", durationWithDefault("RECEIVER_TIMEOUT", 360*time.Second),
+		"deadline of handling a request, as the function timeout is in Fn")
+	fnAPIURL := fs.String("fn-api-url", "", "base URL of the Fn API targets are invoked through (FN_API_URL)")
+	fnAppName := fs.String("fn-app-name", "", "app of the functions targets name (FN_APP_NAME)")
+	fs.Var(configFlag(opts.Config), "config", "KEY=VALUE config, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *fnAPIURL != "" {
+		opts.Config["FN_API_URL"] = *fnAPIURL
+	}
+	if *fnAppName != "" {
+		opts.Config["FN_APP_NAME"] = *fnAppName
+	}
+	return opts, nil
+}
+
+// applyConfig makes the config of the flags visible to the handler,
+// which reads config from the environment wherever it runs.
+func (opts *ServerOptions) applyConfig() error {
+	for k, v := range opts.Config {
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// httpHandler serves the handler the way fdk invokes it: the request
+// headers and URL go into the fdk context, the body is the input and
+// the status and headers the handler sets make up the response.
+type httpHandler struct {
+	timeout time.Duration
+	config  map[string]string
+}
+
+func newHTTPHandler(timeout time.Duration) *httpHandler {
+	return &httpHandler{timeout: timeout, config: utils.BuildConfig()}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := fdk.WithContext(r.Context(), &fdk.Ctx{
+		Header:     r.Header,
+		Config:     h.config,
+		RequestURL: requestURL(r),
+		Method:     r.Method,
+	})
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	var buf bytes.Buffer
+	resp := &utils.Response{Status: http.StatusOK, Header: w.Header(), Writer: &buf}
+	withError(ctx, r.Body, resp)
+	w.WriteHeader(resp.Status)
+	w.Write(buf.Bytes())
+}
+
+// varsHandler serves the counters of the receiver the way expvar does,
+// leaving out the command line, which may carry secrets given with -config.
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// newServeMux routes requests to the handler, except for the counters
+// such as duplicates_suppressed, which are served on /debug/vars.
+func newServeMux(timeout time.Duration) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", newHTTPHandler(timeout))
+	mux.HandleFunc("/debug/vars", varsHandler)
+	return mux
+}
+
+// requestURL is the URL the request was sent to, as far as the receiver
+// can tell behind a proxy.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// serve runs the server until it is interrupted or terminated,
+// letting requests in flight finish.
+func serve(opts *ServerOptions) error {
+	if err := opts.applyConfig(); err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              ":" + opts.Port,
+		Handler:           newServeMux(opts.Timeout),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	log.Printf("listening on %s\n", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fnproject/fdk-go"
+)
+
+func TestParseServerOptions(t *testing.T) {
+	os.Setenv("PORT", "9090")
+	defer os.Unsetenv("PORT")
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected ServerOptions
+	}{
+		{
+			name:     "defaults",
+			expected: ServerOptions{Port: "9090", Timeout: 360 * time.Second, Config: map[string]string{}},
+		},
+		{
+			name: "flags",
+			args: []string{"-http", "-port", "8081", "-timeout", "30s",
+				"-fn-api-url", "http://localhost:8080", "-fn-app-name", "cloudevents",
+				"-config", "S3_PRESIGN=true", "-config", "ROUTES_FILE=routes.example.yaml"},
+			expected: ServerOptions{Enabled: true, Port: "8081", Timeout: 30 * time.Second, Config: map[string]string{
+				"FN_API_URL":  "http://localhost:8080",
+				"FN_APP_NAME": "cloudevents",
+				"S3_PRESIGN":  "true",
+				"ROUTES_FILE": "routes.example.yaml",
+			}},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			opts, err := parseServerOptions(ts.args)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(*opts, ts.expected) {
+				t.Fatalf("Options mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.expected, *opts)
+			}
+		})
+	}
+
+	if _, err := parseServerOptions([]string{"-config", "S3_PRESIGN"}); err == nil {
+		t.Fatal("Expected config without a value to be refused")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	structured, err := ioutil.ReadFile("payloads/aws.v1.0.payload.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	binaryData := `{"s3SchemaVersion":"1.0","configurationId":"cd267a38-30df-400e-9e3d-d0f1ca6e2410",` +
+		`"bucket":{"name":"cloudevents","ownerIdentity":{"principalId":"A3QLJ3P3P5QY05"},"arn":"arn:aws:s3:::cloudevents"},` +
+		`"object":{"key":"dan_kohn.jpg","size":444684,"eTag":"38b01ff16138d7ca0a0eb3f7a88ff815","sequencer":"005AE1E6A9A3D61490"}}`
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		body     string
+		status   int
+		problem  string
+		dispatch int
+	}{
+		{
+			name:     "structured",
+			header:   http.Header{"Content-Type": {structuredContentType}},
+			body:     string(structured),
+			status:   http.StatusOK,
+			dispatch: 1,
+		},
+		{
+			name: "binary",
+			header: http.Header{
+				"Content-Type":   {"application/json"},
+				"Ce-Specversion": {"1.0"},
+				"Ce-Type":        {"aws.s3.object.created"},
+				"Ce-Id":          {"C234-1234-1234"},
+				"Ce-Source":      {"https://serverless.com"},
+				"Ce-Awsregion":   {"us-east-1"},
+			},
+			body:     binaryData,
+			status:   http.StatusOK,
+			dispatch: 1,
+		},
+		{
+			name:    "malformed",
+			header:  http.Header{"Content-Type": {"application/json"}},
+			body:    "{",
+			status:  http.StatusBadRequest,
+			problem: problemTypePrefix + "malformed-event",
+		},
+	}
+
+	srv := httptest.NewServer(newServeMux(time.Minute))
+	defer srv.Close()
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			d := newDispatchRecorder(t)
+			defer d.Close()
+
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/receiver", strings.NewReader(ts.body))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			req.Header = ts.header
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != ts.status {
+				t.Fatalf("Status mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.status, resp.StatusCode)
+			}
+			if len(d.events) != ts.dispatch {
+				t.Fatalf("Dispatch mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.dispatch, len(d.events))
+			}
+			if ts.problem == "" {
+				var hr HandlerResponse
+				if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(hr.Events) != 1 || hr.Events[0].Status != statusDispatched {
+					t.Fatalf("Unexpected response: %v", hr)
+				}
+				if d.events[0].Source != srv.URL+"/receiver" {
+					t.Fatalf("Unexpected outbound event source: %v", d.events[0].Source)
+				}
+				return
+			}
+			if resp.Header.Get("Content-Type") != problemContentType {
+				t.Fatalf("Unexpected content type: %v", resp.Header.Get("Content-Type"))
+			}
+			var p Problem
+			if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+				t.Fatal(err.Error())
+			}
+			if p.Type != ts.problem {
+				t.Fatalf("Problem type mismatch!"+
+					"\n\tExpected: %v"+
+					"\n\tActual: %v", ts.problem, p.Type)
+			}
+		})
+	}
+}
+
+func TestFnTriggerURLOfRequestWithQuery(t *testing.T) {
+	os.Setenv("FN_APP_NAME", "cloudevents")
+	defer os.Unsetenv("FN_APP_NAME")
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:8081/?access_token=s3cr3t", nil)
+	ctx := fdk.WithContext(context.Background(), &fdk.Ctx{Header: r.Header, RequestURL: requestURL(r)})
+
+	expected := "http://localhost:8081/t/cloudevents/image-processor"
+	if actual := fnTriggerURL(ctx, "image-processor"); actual != expected {
+		t.Fatalf("URL mismatch!"+
+			"\n\tExpected: %v"+
+			"\n\tActual: %v", expected, actual)
+	}
+}
+
+func TestVarsHandler(t *testing.T) {
+	srv := httptest.NewServer(newServeMux(time.Minute))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	var vars map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"duplicates_suppressed", "media_out_of_order"} {
+		if _, ok := vars[name]; !ok {
+			t.Fatalf("Expected counter %s, got: %v", name, vars)
+		}
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Fatal("Expected the command line to be left out")
+	}
+}
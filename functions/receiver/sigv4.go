@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// maxPresignExpiry is the longest validity SigV4 allows for pre-signed URLs.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// AWSCredentials sign requests to S3.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromConfig reads the credentials from S3_ACCESS_KEY_ID and
+// S3_SECRET_ACCESS_KEY, meant for S3-compatible stores, or else from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN the
+// function config or the environment holds.
+func awsCredentialsFromConfig() (AWSCredentials, error) {
+	creds := AWSCredentials{
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+	}
+	if creds.AccessKeyID == "" {
+		creds = AWSCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("unable to pre-sign S3 URLs: no credentials, " +
+			"set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return creds, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// sigV4Scope is the credential scope of a request signed at t.
+func sigV4Scope(t time.Time, region, service string) string {
+	return strings.Join([]string{t.UTC().Format(sigV4DateFormat), region, service, "aws4_request"}, "/")
+}
+
+// sigV4SigningKey derives the key of a day, region and service from the secret.
+func sigV4SigningKey(secret string, t time.Time, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), t.UTC().Format(sigV4DateFormat))
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+// sigV4CanonicalQuery sorts parameters by name and value
+// and encodes both the way SigV4 expects.
+func sigV4CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// sigV4CanonicalRequest returns the canonical form of a request along with
+// the names of the signed headers. The path is taken as it is escaped in u,
+// which is what S3 expects.
+func sigV4CanonicalRequest(method string, u *url.URL, query url.Values, headers http.Header, payloadHash string) (string, string) {
+	var names []string
+	canonicalHeaders := map[string]string{}
+	for name, values := range headers {
+		name = strings.ToLower(name)
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		names = append(names, name)
+		canonicalHeaders[name] = strings.Join(trimmed, ",")
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + canonicalHeaders[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		method,
+		path,
+		sigV4CanonicalQuery(query),
+		b.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+// sigV4StringToSign ties the canonical request to the time and scope of the signature.
+func sigV4StringToSign(t time.Time, scope, canonicalRequest string) string {
+	return strings.Join([]string{
+		sigV4Algorithm,
+		t.UTC().Format(sigV4TimeFormat),
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+}
+
+// PresignSigV4 turns the URL of an object into a pre-signed GET URL that is
+// valid for the given duration from t, the only signed header being the host.
+func PresignSigV4(rawURL string, creds AWSCredentials, region, service string, t time.Time, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > maxPresignExpiry {
+		return "", fmt.Errorf("pre-signed URL expiry must be between 1s and %s, got %s", maxPresignExpiry, expires)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	scope := sigV4Scope(t, region, service)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", t.UTC().Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	canonicalRequest, _ := sigV4CanonicalRequest(http.MethodGet, u, query,
+		http.Header{"Host": {u.Host}}, unsignedPayload)
+	key := sigV4SigningKey(creds.SecretAccessKey, t, region, service)
+	signature := hex.EncodeToString(hmacSHA256(key, sigV4StringToSign(t, scope, canonicalRequest)))
+
+	u.RawQuery = sigV4CanonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// s3Signer pre-signs S3 media URLs for S3_PRESIGN_EXPIRY (1h by default).
+type s3Signer struct {
+	creds  AWSCredentials
+	region string
+}
+
+// s3SignerFromConfig returns the signer of S3 media in a region,
+// nil unless S3_PRESIGN is enabled.
+func s3SignerFromConfig(region string) (mediaSigner, error) {
+	if withDefault("S3_PRESIGN", "false") != "true" {
+		return nil, nil
+	}
+	creds, err := awsCredentialsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return s3Signer{creds: creds, region: region}, nil
+}
+
+func (s s3Signer) refuse(rawURL string) string {
+	return ""
+}
+
+func (s s3Signer) sign(rawURL string) (string, error) {
+	expires := durationWithDefault("S3_PRESIGN_EXPIRY", time.Hour)
+	return PresignSigV4(rawURL, s.creds, s.region, "s3", time.Now(), expires)
+}
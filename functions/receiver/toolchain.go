@@ -0,0 +1,9 @@
+//go:build !go1.16
+// +build !go1.16
+
+package main
+
+// The shipped schemas are embedded with go:embed, which takes Go 1.16 or
+// later. Older toolchains would silently leave them out, so the build fails
+// here instead, naming the reason.
+var _ = receiverRequiresGo1_16OrLater
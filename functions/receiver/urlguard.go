@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// URLPolicyError is returned when a media URL must not be handed over
+// to the processors, as it could make them fetch what they should not.
+type URLPolicyError struct {
+	URL    string
+	Reason string
+}
+
+func (e *URLPolicyError) Error() string {
+	return fmt.Sprintf("media URL '%s' rejected: %s", e.URL, e.Reason)
+}
+
+type mediaHostsRegistration struct {
+	typePattern string
+	hosts       func() []string
+}
+
+var (
+	mediaHostsMu sync.RWMutex
+	mediaHosts   []mediaHostsRegistration
+)
+
+// RegisterMediaHosts declares the hosts the media of events whose type
+// matches the pattern is stored on. Host patterns are matched
+// case-insensitively, a '*' matches any sequence of characters.
+// Media of event types without registered hosts may live on any host
+// unless MEDIA_URL_HOSTS says otherwise.
+func RegisterMediaHosts(typePattern string, hosts func() []string) {
+	mediaHostsMu.Lock()
+	defer mediaHostsMu.Unlock()
+	mediaHosts = append(mediaHosts, mediaHostsRegistration{typePattern: typePattern, hosts: hosts})
+}
+
+// lookupMediaHosts returns the host patterns registered for the event,
+// or those of the mapping its media is extracted with.
+func lookupMediaHosts(ce *CloudEvent) []string {
+	var hosts []string
+	if a, err := LookupAdapter(ce); err == nil {
+		if m, ok := a.(*Mapping); ok {
+			hosts = append(hosts, m.Hosts...)
+		}
+	}
+
+	mediaHostsMu.RLock()
+	defer mediaHostsMu.RUnlock()
+	for _, r := range mediaHosts {
+		if globMatch(r.typePattern, ce.EventType) {
+			hosts = append(hosts, r.hosts()...)
+		}
+	}
+	return hosts
+}
+
+// hostOf returns the host of a configured URL such as S3_ENDPOINT, if any.
+func hostOf(rawURL string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	return []string{u.Hostname()}
+}
+
+// lookupIPAddr resolves media hosts, tests replace it
+// so they do not depend on DNS.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// URLPolicy decides which media URLs are safe to dispatch.
+type URLPolicy struct {
+	Schemes      []string
+	Hosts        []string
+	AllowPrivate bool
+}
+
+func urlPolicyFromConfig() URLPolicy {
+	schemes := listFromConfig("MEDIA_URL_SCHEMES")
+	if len(schemes) == 0 {
+		schemes = []string{"https"}
+	}
+	return URLPolicy{
+		Schemes:      schemes,
+		Hosts:        listFromConfig("MEDIA_URL_HOSTS"),
+		AllowPrivate: withDefault("MEDIA_URL_ALLOW_PRIVATE", "false") == "true",
+	}
+}
+
+// disallowedIP reports why an address must not be fetched, if it must not.
+func disallowedIP(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case inNetworks(privateNetworks, ip):
+		return "private"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local"
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsMulticast():
+		return "multicast"
+	case sharedAddressSpace.Contains(ip):
+		return "shared address space"
+	}
+	return ""
+}
+
+// privateNetworks are the private ranges of RFC 1918 and the unique local
+// addresses of RFC 4193, spelled out rather than left to net.IP.IsPrivate,
+// which needs Go 1.17.
+var privateNetworks = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)},
+}
+
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// check returns why a media URL of the event is unsafe, or an empty string.
+func (p URLPolicy) check(ctx context.Context, ce *CloudEvent, rawURL string) string {
+	return p.checkURL(ctx, rawURL, append(lookupMediaHosts(ce), p.Hosts...))
+}
+
+// checkURL returns why a URL is unsafe to fetch, or an empty string. Without
+// host patterns any host is allowed. Hosts are resolved and every address
+// they resolve to must be public, IP literals are checked as they are.
+// The reason goes back to the caller, so the addresses and resolver errors,
+// which tell about the internal network, are only logged.
+func (p URLPolicy) checkURL(ctx context.Context, rawURL string, hosts []string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "malformed URL"
+	}
+	scheme := strings.ToLower(u.Scheme)
+	allowed := false
+	for _, s := range p.Schemes {
+		allowed = allowed || strings.EqualFold(s, scheme)
+	}
+	if !allowed {
+		return fmt.Sprintf("scheme '%s' is not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return "URL carries credentials"
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "URL has no host"
+	}
+
+	if len(hosts) > 0 {
+		allowed = false
+		for _, h := range hosts {
+			allowed = allowed || globMatch(strings.ToLower(h), host)
+		}
+		if !allowed {
+			return fmt.Sprintf("host '%s' is not allowed", host)
+		}
+	}
+
+	if p.AllowPrivate {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if reason := disallowedIP(ip); reason != "" {
+			return fmt.Sprintf("address %s is %s", ip, reason)
+		}
+		return ""
+	}
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		log.Printf("unable to resolve host '%s': %s\n", host, err.Error())
+		return fmt.Sprintf("unable to resolve host '%s'", host)
+	}
+	for _, addr := range addrs {
+		if reason := disallowedIP(addr.IP); reason != "" {
+			log.Printf("host '%s' resolves to %s address %s\n", host, reason, addr.IP)
+			return fmt.Sprintf("host '%s' resolves to a disallowed address (%s)", host, reason)
+		}
+	}
+	return ""
+}
+
+// Apply splits the media of an event into what is safe to dispatch
+// and what is rejected, including media its signer refuses to sign.
+func (p URLPolicy) Apply(ctx context.Context, ce *CloudEvent, media []Media) (safe []Media, rejected []*URLPolicyError) {
+	for _, m := range media {
+		reason := p.check(ctx, ce, m.URL)
+		if reason == "" && m.signer != nil {
+			reason = m.signer.refuse(m.URL)
+		}
+		if reason != "" {
+			rejected = append(rejected, &URLPolicyError{URL: m.reference(), Reason: reason})
+			continue
+		}
+		safe = append(safe, m)
+	}
+	return safe, rejected
+}
+
+// maxRedirects is how many redirects are followed when fetching media or schemas.
+const maxRedirects = 5
+
+// checkRedirect follows redirects only to URLs check finds no fault with,
+// so a redirect does not get around the URL policy.
+func checkRedirect(check func(rawURL string) string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		if reason := check(req.URL.String()); reason != "" {
+			return &URLPolicyError{URL: withoutQuery(req.URL.String()), Reason: reason}
+		}
+		return nil
+	}
+}